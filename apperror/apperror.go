@@ -0,0 +1,170 @@
+// Package apperror defines the errors handlers return to clients and
+// writes them as RFC 7807 problem details.
+package apperror
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Kind decides the HTTP status of an Error.
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindTooManyRequests
+	KindUnavailable
+	KindUnsupportedMediaType
+	KindRequestTooLarge
+)
+
+var statuses = map[Kind]int{
+	KindInternal:             http.StatusInternalServerError,
+	KindValidation:           http.StatusBadRequest,
+	KindUnauthorized:         http.StatusUnauthorized,
+	KindForbidden:            http.StatusForbidden,
+	KindNotFound:             http.StatusNotFound,
+	KindConflict:             http.StatusConflict,
+	KindTooManyRequests:      http.StatusTooManyRequests,
+	KindUnavailable:          http.StatusBadGateway,
+	KindUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	KindRequestTooLarge:      http.StatusRequestEntityTooLarge,
+}
+
+// Error is an error meant for the client. Code is a stable, machine
+// readable identifier such as "course_not_found"; Detail is for humans.
+// Extensions become extra members of the problem body. Err is the
+// underlying cause and is only logged.
+type Error struct {
+	Kind       Kind
+	Code       string
+	Detail     string
+	Extensions map[string]interface{}
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Status is the HTTP status the error is reported with.
+func (e *Error) Status() int {
+	return statuses[e.Kind]
+}
+
+// With adds an extension member to the problem body.
+func (e *Error) With(key string, value interface{}) *Error {
+	if e.Extensions == nil {
+		e.Extensions = map[string]interface{}{}
+	}
+	e.Extensions[key] = value
+	return e
+}
+
+func newError(kind Kind, code, detail string) *Error {
+	return &Error{Kind: kind, Code: code, Detail: detail}
+}
+
+func Validation(code, detail string) *Error {
+	return newError(KindValidation, code, detail)
+}
+
+func Unauthorized(code, detail string) *Error {
+	return newError(KindUnauthorized, code, detail)
+}
+
+func Forbidden(code, detail string) *Error {
+	return newError(KindForbidden, code, detail)
+}
+
+func NotFound(code, detail string) *Error {
+	return newError(KindNotFound, code, detail)
+}
+
+func Conflict(code, detail string) *Error {
+	return newError(KindConflict, code, detail)
+}
+
+func TooManyRequests(code, detail string) *Error {
+	return newError(KindTooManyRequests, code, detail)
+}
+
+func UnsupportedMediaType(code, detail string) *Error {
+	return newError(KindUnsupportedMediaType, code, detail)
+}
+
+func RequestTooLarge(code, detail string) *Error {
+	return newError(KindRequestTooLarge, code, detail)
+}
+
+// Unavailable reports that a service we depend on failed.
+func Unavailable(code, detail string, err error) *Error {
+	e := newError(KindUnavailable, code, detail)
+	e.Err = err
+	return e
+}
+
+// Internal wraps an unexpected error. Its message is logged, never sent.
+func Internal(err error) *Error {
+	e := newError(KindInternal, "internal_error", "An unexpected error occurred")
+	e.Err = err
+	return e
+}
+
+// From converts any error to an *Error. A missing Mongo document becomes a
+// generic not found; anything else not already an *Error is internal.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return NotFound("not_found", "The requested resource was not found")
+	}
+	return Internal(err)
+}
+
+// Respond writes err as an application/problem+json body.
+func Respond(c *gin.Context, err error) {
+	appErr := From(err)
+	status := appErr.Status()
+	if appErr.Kind == KindInternal || appErr.Kind == KindUnavailable {
+		log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, appErr)
+	}
+
+	body := gin.H{}
+	for key, value := range appErr.Extensions {
+		body[key] = value
+	}
+	body["type"] = "about:blank"
+	body["title"] = http.StatusText(status)
+	body["status"] = status
+	body["detail"] = appErr.Detail
+	body["instance"] = c.Request.URL.Path
+	body["code"] = appErr.Code
+
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(status, body)
+}
+
+// Abort responds with err and stops the handler chain, for middleware.
+func Abort(c *gin.Context, err error) {
+	Respond(c, err)
+	c.Abort()
+}
@@ -1,80 +1,173 @@
 package auth
 
 import (
-	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	"github.com/phcarneirobc/free-learn/db"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/phcarneirobc/free-learn/apperror"
 	"github.com/phcarneirobc/free-learn/model"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
-
 const (
 	ErrInvalidTokenSignature = "Invalid token signature"
 	ErrCouldNotParseToken    = "Could not parse token"
 )
 
+var errInvalidChallengeToken = apperror.Unauthorized("invalid_challenge_token", "Invalid or expired challenge token")
+
+// PurposeTwoFactor marks the short-lived token returned by the password
+// step of a two-step login. It only grants access to the second step.
+const PurposeTwoFactor = "2fa"
+
+const challengeTokenExpiry = 5 * time.Minute
+
+// tokenLeeway tolerates clock skew between us and services verifying our
+// tokens.
+const tokenLeeway = 30 * time.Second
+
+const (
+	RoleProfessor = "professor"
+	RoleAdmin     = "admin"
+)
+
+// Claims identify the user by ID in the subject. Email and Roles are
+// informational for other services; this API reads the user's current
+// state instead of trusting them.
 type Claims struct {
-	Email string `json:"email"`
-	jwt.StandardClaims
+	Email   string   `json:"email"`
+	Roles   []string `json:"roles,omitempty"`
+	Purpose string   `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// tokenIssuer and tokenAudience come from JWT_ISSUER and JWT_AUDIENCE.
+func tokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "free-learn"
+}
+
+func tokenAudience() string {
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return "free-learn-api"
+}
+
+func newClaims(user models.User, purpose string, lifetime time.Duration) *Claims {
+	now := time.Now()
+	roles := []string{}
+	if user.Professor {
+		roles = append(roles, RoleProfessor)
+	}
+	if user.Admin {
+		roles = append(roles, RoleAdmin)
+	}
+	return &Claims{
+		Email:   user.Email,
+		Roles:   roles,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer(),
+			Subject:   user.Id.Hex(),
+			Audience:  jwt.ClaimStrings{tokenAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        primitive.NewObjectID().Hex(),
+		},
+	}
 }
 
+// AuthenticateToken accepts a session JWT as a Bearer token, or an API key
+// either as a Bearer token or in the X-API-Key header.
 func AuthenticateToken(c *gin.Context) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		authenticateAPIKey(c, key)
+		return
+	}
+
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No Authorization header provided"})
+		apperror.Abort(c, apperror.Unauthorized("missing_authorization", "No Authorization header provided"))
 		return
 	}
 
 	bearerToken := strings.Split(authHeader, " ")
 	if len(bearerToken) != 2 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header format"})
+		apperror.Abort(c, apperror.Unauthorized("invalid_authorization_header", "Invalid Authorization header format"))
 		return
 	}
 
-	token, err := jwt.ParseWithClaims(bearerToken[1], &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("Unexpected signing method")
-		}
-		return jwtKey, nil
-	})
+	if strings.HasPrefix(bearerToken[1], APIKeyPrefix) {
+		authenticateAPIKey(c, bearerToken[1])
+		return
+	}
 
+	claims, err := parseToken(bearerToken[1], "")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		code := "invalid_token"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			code = "token_expired"
+		}
+		apperror.Abort(c, apperror.Unauthorized(code, err.Error()))
 		return
 	}
 
-	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		apperror.Abort(c, apperror.Unauthorized("invalid_token", "Invalid token"))
 		return
 	}
 
-	var user models.User
-	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
-	err = collection.FindOne(context.Background(), bson.M{"email": claims.Email}).Decode(&user)
+	user, err := lookupUser(userID)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			apperror.Abort(c, apperror.Unauthorized("user_not_found", "User not found"))
 			return
 		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		apperror.Abort(c, err)
+		return
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(claims.ID)
+	if err != nil {
+		apperror.Abort(c, apperror.Unauthorized("invalid_token", "Invalid token"))
+		return
+	}
+
+	session, err := lookupSession(sessionID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		apperror.Abort(c, err)
+		return
+	}
+	if err == mongo.ErrNoDocuments || session.RevokedAt != nil || session.UserID != user.Id {
+		apperror.Abort(c, apperror.Unauthorized("session_revoked", "Session has been revoked"))
 		return
 	}
+	touchSession(session)
 
+	c.Set("sessionID", session.Id)
+	setAuthenticatedUser(c, *user)
+	c.Next()
+}
+
+func setAuthenticatedUser(c *gin.Context, user models.User) {
 	c.Set("userID", user.Id)
 	c.Set("userProfessor", user.Professor)
-	c.Next()
+	c.Set("userTwoFactorMissing", TwoFactorRequired(user) && !user.TOTPEnabled)
 }
 
 func HashPassword(password string) (string, error) {
@@ -87,40 +180,100 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func GenerateToken(user models.User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Email: user.Email,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+// GenerateOpaqueToken returns a random URL-safe token for links sent by
+// email. Only its HashOpaqueToken digest should be stored.
+func GenerateOpaqueToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		return "", err
+// signToken signs with the keyring's current key and names it in the kid
+// header, so verifiers know which of the published keys to use.
+func signToken(claims *Claims) (string, error) {
+	if keyring == nil {
+		return "", errors.New("JWT signing keys are not loaded")
 	}
 
-	return tokenString, nil
+	key := keyring.current()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
 }
 
-func ValidateToken(tknStr string) (bool, string) {
+// parseToken is the only place tokens are verified. It accepts nothing but
+// RS256 signed by one of our keys, and only tokens issued for purpose,
+// where "" is a regular session token.
+func parseToken(tokenString string, purpose string) (*Claims, error) {
+	if keyring == nil {
+		return nil, errors.New("JWT signing keys are not loaded")
+	}
+
 	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		public, ok := keyring.publicKey(kid)
+		if !ok {
+			return nil, errors.New("Unknown signing key")
+		}
+		return public, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(tokenIssuer()),
+		jwt.WithAudience(tokenAudience()),
+		jwt.WithLeeway(tokenLeeway),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
 
-	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	if !token.Valid || claims.Purpose != purpose {
+		return nil, errors.New("Invalid token")
+	}
+	return claims, nil
+}
 
+// GenerateChallengeToken issues the intermediate token of a two-step login.
+// AuthenticateToken refuses it; only ValidateChallengeToken accepts it.
+func GenerateChallengeToken(user models.User) (string, error) {
+	return signToken(newClaims(user, PurposeTwoFactor, challengeTokenExpiry))
+}
+
+// ValidateChallengeToken returns the ID of the user a challenge token was
+// issued to.
+func ValidateChallengeToken(tknStr string) (primitive.ObjectID, error) {
+	claims, err := parseToken(tknStr, PurposeTwoFactor)
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			return false, ErrInvalidTokenSignature
-		}
-		return false, ErrCouldNotParseToken
+		return primitive.NilObjectID, errInvalidChallengeToken
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return primitive.NilObjectID, errInvalidChallengeToken
 	}
+	return userID, nil
+}
+
+// TwoFactorRequired reports whether policy obliges the user to use 2FA.
+// Setting REQUIRE_STAFF_2FA=true requires it for professors and admins.
+func TwoFactorRequired(user models.User) bool {
+	return (user.Professor || user.Admin) && os.Getenv("REQUIRE_STAFF_2FA") == "true"
+}
 
-	if !tkn.Valid {
+func ValidateToken(tknStr string) (bool, string) {
+	claims, err := parseToken(tknStr, "")
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenMalformed) {
+			return false, ErrCouldNotParseToken
+		}
 		return false, ErrInvalidTokenSignature
 	}
 
@@ -130,7 +283,11 @@ func ValidateToken(tknStr string) (bool, string) {
 func RequireProfessor(c *gin.Context) {
 	userProfessor, exists := c.Get("userProfessor")
 	if !exists || !userProfessor.(bool) {
-		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access forbidden: professors only"})
+		apperror.Abort(c, apperror.Forbidden("professor_required", "Access forbidden: professors only"))
+		return
+	}
+	if missing, _ := c.Get("userTwoFactorMissing"); missing == true {
+		apperror.Abort(c, apperror.Forbidden("two_factor_setup_required", "Two-factor authentication must be enabled for this account"))
 		return
 	}
 	c.Next()
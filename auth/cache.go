@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phcarneirobc/free-learn/db"
+	"github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxCacheEntries bounds each cache; when full it is simply emptied.
+const maxCacheEntries = 10000
+
+// ttlCache spares AuthenticateToken database reads on every request. It is
+// off unless AUTH_USER_CACHE_TTL is set, since a cached entry can be up to
+// that old: a revoked session or a lost professor flag takes effect on
+// other instances only once their entry expires. Changes made through this
+// instance call InvalidateUser or InvalidateSession and take effect
+// immediately.
+type ttlCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[primitive.ObjectID]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+var (
+	users    = newTTLCache()
+	sessions = newTTLCache()
+)
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: map[primitive.ObjectID]cacheEntry{}}
+}
+
+// configureCaches reads AUTH_USER_CACHE_TTL, a duration such as "30s".
+func configureCaches() {
+	ttl, _ := time.ParseDuration(os.Getenv("AUTH_USER_CACHE_TTL"))
+	for _, cache := range []*ttlCache{users, sessions} {
+		cache.mu.Lock()
+		cache.ttl = ttl
+		cache.mu.Unlock()
+	}
+}
+
+// get returns the cached value for id, loading and caching it on a miss.
+func (c *ttlCache) get(id primitive.ObjectID, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	ttl := c.ttl
+	entry, ok := c.entries[id]
+	c.mu.Unlock()
+
+	if ttl <= 0 {
+		return load()
+	}
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = map[primitive.ObjectID]cacheEntry{}
+	}
+	c.entries[id] = cacheEntry{value: value, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+func (c *ttlCache) invalidate(id primitive.ObjectID) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
+
+// lookupUser returns the user, from the cache when enabled.
+func lookupUser(id primitive.ObjectID) (*models.User, error) {
+	value, err := users.get(id, func() (interface{}, error) {
+		var user models.User
+		collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+		err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&user)
+		return user, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user := value.(models.User)
+	return &user, nil
+}
+
+// lookupSession returns the session, from the cache when enabled.
+func lookupSession(id primitive.ObjectID) (*models.Session, error) {
+	value, err := sessions.get(id, func() (interface{}, error) {
+		var session models.Session
+		collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SessionCollection)
+		err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&session)
+		return session, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	session := value.(models.Session)
+	return &session, nil
+}
+
+// InvalidateUser drops the cached copy of the user. Call it after changing
+// anything AuthenticateToken depends on.
+func InvalidateUser(id primitive.ObjectID) {
+	users.invalidate(id)
+}
+
+// InvalidateSession drops the cached copy of the session. Call it after
+// revoking the session.
+func InvalidateSession(id primitive.ObjectID) {
+	sessions.invalidate(id)
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A new key is published in the JWKS this long before it starts signing,
+// so services that cache our keys have picked it up by then. A replaced
+// key keeps verifying for tokenLifetime after that, until every token it
+// signed has expired.
+const (
+	keyActivationDelay = time.Hour
+	tokenLifetime      = 24 * time.Hour
+	rsaKeyBits         = 2048
+	createdHeader      = "Created"
+)
+
+type signingKey struct {
+	kid     string
+	private *rsa.PrivateKey
+	created time.Time
+}
+
+// Keyring holds the RSA keys tokens are signed with, one PEM file per key
+// in a directory. The file name without ".pem" is the key's kid and the
+// PEM block's Created header is when the key was created. Keys made
+// without the header, like those of `make keys`, were created when the
+// file was last modified. Loading never writes to the directory, which
+// may be a read-only mount.
+type Keyring struct {
+	mu   sync.RWMutex
+	dir  string
+	keys []signingKey
+}
+
+var keyring *Keyring
+
+// Init loads the signing keys from JWT_KEYS_DIR (default "keys") and, if
+// JWT_ROTATION_INTERVAL is set, starts rotating them. It fails when there
+// is no key, so the API never runs with tokens it cannot sign safely. It
+// also configures the caches.
+func Init() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		dir = "keys"
+	}
+
+	ring, err := LoadKeyring(dir)
+	if err != nil {
+		return err
+	}
+	keyring = ring
+	configureCaches()
+
+	if value := os.Getenv("JWT_ROTATION_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= keyActivationDelay {
+			return fmt.Errorf("JWT_ROTATION_INTERVAL must be a duration longer than %s", keyActivationDelay)
+		}
+		go ring.rotateEvery(interval)
+	}
+	return nil
+}
+
+func LoadKeyring(dir string) (*Keyring, error) {
+	ring := &Keyring{dir: dir}
+	if err := ring.reload(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// reload reads every key in the directory, so keys added by another
+// instance or by hand are picked up.
+func (k *Keyring) reload() error {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := []signingKey{}
+	for _, path := range paths {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no JWT signing keys found in %q; create one with `make keys`", k.dir)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].created.Before(keys[j].created) })
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func readSigningKey(path string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var private *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if private, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = errors.New("not an RSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	created, err := keyCreated(path, block)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return signingKey{
+		kid:     strings.TrimSuffix(filepath.Base(path), ".pem"),
+		private: private,
+		created: created,
+	}, nil
+}
+
+// keyCreated reads the creation time from the Created header of the key's
+// PEM block, falling back to the file's modification time, which every
+// instance sharing the directory reads the same.
+func keyCreated(path string, block *pem.Block) (time.Time, error) {
+	if value, ok := block.Headers[createdHeader]; ok {
+		return time.Parse(time.RFC3339, value)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// writeKeyFile writes the file at path through a rename, so other
+// instances reading the directory never see it half written.
+func writeKeyFile(path string, block *pem.Block) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// current returns the key new tokens are signed with: the newest one past
+// its activation delay, or the oldest key if none is yet.
+func (k *Keyring) current() signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	current := k.keys[0]
+	for _, key := range k.keys[1:] {
+		if now.Sub(key.created) >= keyActivationDelay {
+			current = key
+		}
+	}
+	return current
+}
+
+// verificationKeys returns the keys tokens may still be signed with: every
+// key except those replaced long enough ago that their tokens expired.
+func (k *Keyring) verificationKeys() []signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	keys := []signingKey{}
+	for i, key := range k.keys {
+		if i+1 < len(k.keys) {
+			replacedAt := k.keys[i+1].created.Add(keyActivationDelay)
+			if now.After(replacedAt.Add(tokenLifetime)) {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (k *Keyring) publicKey(kid string) (*rsa.PublicKey, bool) {
+	for _, key := range k.verificationKeys() {
+		if key.kid == kid {
+			return &key.private.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// rotateEvery adds a new key once the newest is older than interval and
+// deletes keys that no longer verify anything. It also reloads the
+// directory on every check to see keys rotated by other instances.
+func (k *Keyring) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := k.rotate(interval); err != nil {
+			log.Printf("auth: rotating signing keys: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (k *Keyring) rotate(interval time.Duration) error {
+	if err := k.reload(); err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	newest := k.keys[len(k.keys)-1]
+	k.mu.RUnlock()
+
+	if time.Since(newest.created) >= interval {
+		if err := k.generate(); err != nil {
+			return err
+		}
+	}
+
+	active := map[string]bool{}
+	for _, key := range k.verificationKeys() {
+		active[key.kid] = true
+	}
+	k.mu.RLock()
+	retired := []string{}
+	for _, key := range k.keys {
+		if !active[key.kid] {
+			retired = append(retired, key.kid)
+		}
+	}
+	k.mu.RUnlock()
+	for _, kid := range retired {
+		if err := os.Remove(filepath.Join(k.dir, kid+".pem")); err != nil {
+			return err
+		}
+	}
+
+	return k.reload()
+}
+
+func (k *Keyring) generate() error {
+	private, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	return writeKeyFile(filepath.Join(k.dir, hex.EncodeToString(id)+".pem"), &pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: map[string]string{createdHeader: time.Now().UTC().Format(time.RFC3339)},
+		Bytes:   x509.MarshalPKCS1PrivateKey(private),
+	})
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS serves the public keys tokens can currently be verified with, for
+// other services that accept our tokens.
+func JWKS(c *gin.Context) {
+	keys := []jwk{}
+	if keyring != nil {
+		for _, key := range keyring.verificationKeys() {
+			public := key.private.PublicKey
+			keys = append(keys, jwk{
+				Kty: "RSA",
+				Use: "sig",
+				Alg: "RS256",
+				Kid: key.kid,
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		}
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/db"
+	"github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// lastSeenInterval limits how often a session's last_seen is written, so
+// busy clients do not cause a write on every request.
+const lastSeenInterval = time.Minute
+
+// NewSession records a login by the client making the request and returns
+// the token for it.
+func NewSession(c *gin.Context, user models.User) (string, error) {
+	now := time.Now()
+	session := models.Session{
+		Id:        primitive.NewObjectID(),
+		Date:      primitive.NewDateTimeFromTime(now),
+		UserID:    user.Id,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		LastSeen:  primitive.NewDateTimeFromTime(now),
+		ExpiresAt: primitive.NewDateTimeFromTime(now.Add(tokenLifetime)),
+	}
+	if _, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.SessionCollection, session); err != nil {
+		return "", err
+	}
+
+	claims := newClaims(user, "", tokenLifetime)
+	claims.ID = session.Id.Hex()
+	return signToken(claims)
+}
+
+// touchSession records that the session was just used.
+func touchSession(session *models.Session) {
+	if time.Since(session.LastSeen.Time()) < lastSeenInterval {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SessionCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": session.Id}, bson.M{"$set": bson.M{
+		"last_seen": primitive.NewDateTimeFromTime(time.Now()),
+	}})
+	if err != nil {
+		log.Printf("auth: updating last_seen of session %s: %v", session.Id.Hex(), err)
+	}
+	InvalidateSession(session.Id)
+}
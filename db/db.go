@@ -29,7 +29,7 @@ func StartDB() error {
 		Context: ctx,
 	}
 
-	return nil
+	return EnsureIndexes(ctx)
 }
 
 func connect(uri string) (*mongo.Client, context.Context, context.CancelFunc, error) {
@@ -6,6 +6,22 @@ import (
 
 const CourseCollection = "course"
 const UserCollection = "users"
+const QuizAttemptCollection = "quiz_attempts"
+const SubmissionCollection = "submissions"
+const ProgressCollection = "progress"
+const CertificateCollection = "certificates"
+const LearningPathCollection = "learning_paths"
+const CohortCollection = "cohorts"
+const ThreadCollection = "threads"
+const PostCollection = "posts"
+const NoteCollection = "notes"
+const BookmarkCollection = "bookmarks"
+const SecurityEventCollection = "security_events"
+const LoginAttemptCollection = "login_attempts"
+const OIDCStateCollection = "oidc_states"
+const ExternalLoginCollection = "external_logins"
+const APIKeyCollection = "api_keys"
+const SessionCollection = "sessions"
 
 func getDbConnectionString() string {
 	str := os.Getenv("DB_CONNECTION_STRING")
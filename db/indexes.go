@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes are created at startup. Unique ones back the checks that would
+// otherwise race between concurrent requests.
+var indexes = map[string][]mongo.IndexModel{
+	CertificateCollection: {
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "course_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	QuizAttemptCollection: {
+		{
+			// Attempts stored before attempts were numbered have no number.
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "course_id", Value: 1}, {Key: "module", Value: 1}, {Key: "number", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"number": bson.M{"$gt": 0}}),
+		},
+	},
+	SubmissionCollection: {
+		{
+			Keys:    bson.D{{Key: "course_id", Value: 1}, {Key: "assignment_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+}
+
+// EnsureIndexes creates the indexes that do not exist yet.
+func EnsureIndexes(ctx context.Context) error {
+	database := Instance.Client.Database(Instance.Dbname)
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
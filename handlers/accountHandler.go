@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	"github.com/phcarneirobc/free-learn/mail"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	emailChangeTokenExpiry   = 24 * time.Hour
+	passwordResetTokenExpiry = time.Hour
+)
+
+const (
+	eventPasswordChanged      = "password_changed"
+	eventEmailChangeRequested = "email_change_requested"
+	eventEmailChanged         = "email_changed"
+	eventPasswordReset        = "password_reset"
+)
+
+type changePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,password"`
+}
+
+func ChangePassword(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input changePasswordInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !checkCurrentPassword(c, user, input.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(input.NewPassword)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := updateUserByID(user.Id, bson.M{"$set": bson.M{"password": hashedPassword}}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := revokeOtherSessions(c, user.Id); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventPasswordChanged)
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+type requestEmailChangeInput struct {
+	Password string `json:"password" binding:"required"`
+	NewEmail string `json:"new_email" binding:"required,email,max=254"`
+}
+
+// RequestEmailChange starts an email change. The new address only replaces
+// the current one once its owner confirms the code sent to it.
+func RequestEmailChange(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input requestEmailChangeInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !checkCurrentPassword(c, user, input.Password, "Password is incorrect") {
+		return
+	}
+
+	newEmail := strings.ToLower(strings.TrimSpace(input.NewEmail))
+	if address, err := netmail.ParseAddress(newEmail); err != nil || address.Address != newEmail {
+		apperror.Respond(c, apperror.Validation("invalid_email", "Invalid email address"))
+		return
+	}
+
+	if newEmail == user.Email {
+		apperror.Respond(c, apperror.Validation("email_unchanged", "New email is the same as the current one"))
+		return
+	}
+
+	existing, err := getUserByEmail(newEmail)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if existing != nil {
+		apperror.Respond(c, errEmailTaken)
+		return
+	}
+
+	token, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	err = updateUserByID(user.Id, bson.M{"$set": bson.M{
+		"pending_email":        newEmail,
+		"email_change_token":   auth.HashOpaqueToken(token),
+		"email_change_expires": primitive.NewDateTimeFromTime(time.Now().Add(emailChangeTokenExpiry)),
+	}})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	body := fmt.Sprintf("Someone asked to use this address for their FreeLearn account.\n\n"+
+		"To confirm, use this code within 24 hours:\n\n%s\n\n"+
+		"If this wasn't you, you can ignore this email.", token)
+	if err := mail.Send(newEmail, "Confirm your new FreeLearn email address", body); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventEmailChangeRequested)
+	c.JSON(http.StatusOK, gin.H{"message": "Confirmation sent to the new email address"})
+}
+
+type confirmEmailChangeInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ConfirmEmailChange is public because it is reached from the confirmation
+// email; the token itself proves access to the new address.
+func ConfirmEmailChange(c *gin.Context) {
+	var input confirmEmailChangeInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	var user models.User
+	err := collection.FindOne(context.Background(), bson.M{
+		"email_change_token":   auth.HashOpaqueToken(input.Token),
+		"email_change_expires": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.Validation("invalid_or_expired_token", "Invalid or expired token"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	existing, err := getUserByEmail(user.PendingEmail)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if existing != nil {
+		apperror.Respond(c, errEmailTaken)
+		return
+	}
+
+	oldEmail := user.Email
+	err = updateUserByID(user.Id, bson.M{
+		"$set":   bson.M{"email": user.PendingEmail},
+		"$unset": bson.M{"pending_email": "", "email_change_token": "", "email_change_expires": ""},
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := revokeSessions(bson.M{"user_id": user.Id}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	body := fmt.Sprintf("The email address of your FreeLearn account was changed to %s.\n\n"+
+		"If you did not make this change, contact support immediately.", user.PendingEmail)
+	if err := mail.Send(oldEmail, "Your FreeLearn email address was changed", body); err != nil {
+		log.Printf("account: notifying %s of email change: %v", oldEmail, err)
+	}
+
+	recordSecurityEvent(c, user.Id, eventEmailChanged)
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed successfully, please log in again"})
+}
+
+type forgotPasswordInput struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPassword emails a reset code if the address belongs to an account.
+// It answers at once, before looking the address up, so neither the
+// response nor its timing tells whether the account exists.
+func ForgotPassword(c *gin.Context) {
+	var input forgotPasswordInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	email := strings.TrimSpace(input.Email)
+	go func() {
+		if err := sendPasswordReset(email); err != nil {
+			log.Printf("account: sending password reset: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a reset code has been sent to it"})
+}
+
+func sendPasswordReset(email string) error {
+	user, err := getUserByEmail(email)
+	if err != nil || user == nil {
+		return err
+	}
+
+	token, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = updateUserByID(user.Id, bson.M{"$set": bson.M{
+		"password_reset_token":   auth.HashOpaqueToken(token),
+		"password_reset_expires": primitive.NewDateTimeFromTime(time.Now().Add(passwordResetTokenExpiry)),
+	}})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password of your FreeLearn account.\n\n"+
+		"To choose a new password, use this code within an hour:\n\n%s\n\n"+
+		"If this wasn't you, you can ignore this email.", token)
+	if err := mail.Send(user.Email, "Reset your FreeLearn password", body); err != nil {
+		return fmt.Errorf("to %s: %w", user.Email, err)
+	}
+	return nil
+}
+
+type resetPasswordInput struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,password"`
+}
+
+// ResetPassword sets a new password from an emailed reset code. Since it
+// proves control of the address, it also lifts any login lockout and ends
+// every existing session.
+func ResetPassword(c *gin.Context) {
+	var input resetPasswordInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	var user models.User
+	err := collection.FindOne(context.Background(), bson.M{
+		"password_reset_token":   auth.HashOpaqueToken(input.Token),
+		"password_reset_expires": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.Validation("invalid_or_expired_token", "Invalid or expired token"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(input.NewPassword)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	err = updateUserByID(user.Id, bson.M{
+		"$set":   bson.M{"password": hashedPassword},
+		"$unset": bson.M{"password_reset_token": "", "password_reset_expires": ""},
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := revokeSessions(bson.M{"user_id": user.Id}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := clearLoginFailures(user.Email); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventPasswordReset)
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully, please log in again"})
+}
+
+type securityEventResponse struct {
+	Id        primitive.ObjectID `json:"_id"`
+	Date      primitive.DateTime `json:"date"`
+	Type      string             `json:"type"`
+	IP        string             `json:"ip"`
+	UserAgent string             `json:"user_agent"`
+}
+
+func securityEventResponseOf(event models.SecurityEvent) securityEventResponse {
+	return securityEventResponse{
+		Id:        event.Id,
+		Date:      event.Date,
+		Type:      event.Type,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+	}
+}
+
+func GetSecurityEvents(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SecurityEventCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(100)
+	cursor, err := collection.Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	events := []models.SecurityEvent{}
+	if err = cursor.All(context.Background(), &events); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(events, securityEventResponseOf))
+}
+
+// recordSecurityEvent keeps an audit trail of sensitive account changes.
+// Failing to record one is logged but does not fail the request, since the
+// change itself has already been applied.
+func recordSecurityEvent(c *gin.Context, userID primitive.ObjectID, eventType string) {
+	event := models.SecurityEvent{
+		Id:        primitive.NewObjectID(),
+		Date:      primitive.NewDateTimeFromTime(time.Now()),
+		UserID:    userID,
+		Type:      eventType,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.SecurityEventCollection, event)
+	if err != nil {
+		log.Printf("account: recording %s event for %s: %v", eventType, userID.Hex(), err)
+	}
+}
+
+func currentUser(c *gin.Context) (*models.User, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return nil, false
+	}
+
+	user, err := getUserByID(userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func updateUserByID(id primitive.ObjectID, update bson.M) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, update)
+	auth.InvalidateUser(id)
+	return err
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAPIKeyDays = 90
+	maxAPIKeysPerUser = 20
+)
+
+const (
+	eventAPIKeyCreated = "api_key_created"
+	eventAPIKeyRevoked = "api_key_revoked"
+)
+
+// createdAPIKey is the only response that contains the key itself.
+type createdAPIKey struct {
+	Key    string         `json:"key"`
+	APIKey apiKeyResponse `json:"api_key"`
+}
+
+type apiKeyResponse struct {
+	Id         primitive.ObjectID  `json:"_id"`
+	Date       primitive.DateTime  `json:"date"`
+	Name       string              `json:"name"`
+	Prefix     string              `json:"prefix"`
+	Scopes     []string            `json:"scopes"`
+	ExpiresAt  primitive.DateTime  `json:"expires_at"`
+	LastUsedAt *primitive.DateTime `json:"last_used_at"`
+	LastUsedIP string              `json:"last_used_ip,omitempty"`
+}
+
+func apiKeyResponseOf(key models.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		Id:         key.Id,
+		Date:       key.Date,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+	}
+}
+
+type postAPIKeyInput struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"dive,oneof=read write"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0,max=365"`
+}
+
+// PostAPIKey creates a key for the user. The key itself is only in this
+// response; afterwards just its prefix is known.
+func PostAPIKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	var input postAPIKeyInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		apperror.Respond(c, apperror.Validation("name_required", "name is required"))
+		return
+	}
+	if len(input.Scopes) == 0 {
+		input.Scopes = []string{models.ScopeRead}
+	}
+	if input.ExpiresInDays == 0 {
+		input.ExpiresInDays = defaultAPIKeyDays
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.APIKeyCollection)
+	active, err := collection.CountDocuments(context.Background(), activeAPIKeysFilter(userID.(primitive.ObjectID)))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if active >= maxAPIKeysPerUser {
+		apperror.Respond(c, apperror.Conflict("api_key_limit_reached", fmt.Sprintf("at most %d active API keys are allowed", maxAPIKeysPerUser)))
+		return
+	}
+
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	now := time.Now()
+	apiKey := models.APIKey{
+		Id:        primitive.NewObjectID(),
+		Date:      primitive.NewDateTimeFromTime(now),
+		UserID:    userID.(primitive.ObjectID),
+		Name:      input.Name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    input.Scopes,
+		ExpiresAt: primitive.NewDateTimeFromTime(now.Add(time.Duration(input.ExpiresInDays) * 24 * time.Hour)),
+	}
+	if _, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.APIKeyCollection, apiKey); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, apiKey.UserID, eventAPIKeyCreated)
+	c.JSON(http.StatusOK, createdAPIKey{Key: key, APIKey: apiKeyResponseOf(apiKey)})
+}
+
+// GetAPIKeys lists the user's keys that have not been revoked, including
+// expired ones so they can be told apart from missing ones.
+func GetAPIKeys(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.APIKeyCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}})
+	cursor, err := collection.Find(context.Background(), bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, opts)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	keys := []models.APIKey{}
+	if err = cursor.All(context.Background(), &keys); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(keys, apiKeyResponseOf))
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	keyID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_api_key_id", "Invalid API key ID"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.APIKeyCollection)
+	now := primitive.NewDateTimeFromTime(time.Now())
+	result, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": keyID, "user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": now}},
+	)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		apperror.Respond(c, apperror.NotFound("api_key_not_found", "API key not found"))
+		return
+	}
+
+	recordSecurityEvent(c, userID.(primitive.ObjectID), eventAPIKeyRevoked)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+func activeAPIKeysFilter(userID primitive.ObjectID) bson.M {
+	return bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}
+}
@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errAlreadyGraded = apperror.Conflict("already_graded", "Submission has already been graded")
+
+const (
+	submissionMissing   = "missing"
+	submissionSubmitted = "submitted"
+	submissionGraded    = "graded"
+)
+
+type gradebookAssignment struct {
+	AssignmentID primitive.ObjectID `json:"assignment_id"`
+	Title        string             `json:"title"`
+	Status       string             `json:"status"`
+	Late         bool               `json:"late"`
+	Score        *int               `json:"score"`
+	FinalScore   *int               `json:"final_score"`
+	MaxScore     int                `json:"max_score"`
+}
+
+type gradebookQuiz struct {
+	Module    int  `json:"module"`
+	Attempts  int  `json:"attempts"`
+	KeptScore *int `json:"kept_score"`
+	Passed    bool `json:"passed"`
+}
+
+type gradebookRow struct {
+	UserID      primitive.ObjectID    `json:"user_id"`
+	Email       string                `json:"email"`
+	Assignments []gradebookAssignment `json:"assignments"`
+	Quizzes     []gradebookQuiz       `json:"quizzes"`
+}
+
+type submitAssignmentInput struct {
+	Text  string   `json:"text" binding:"max=50000"`
+	Files []string `json:"files" binding:"max=20,dive,max=2048"`
+}
+
+type submissionResponse struct {
+	Id           primitive.ObjectID  `json:"_id"`
+	Date         primitive.DateTime  `json:"date"`
+	AssignmentID primitive.ObjectID  `json:"assignment_id"`
+	CourseID     primitive.ObjectID  `json:"course_id"`
+	UserID       primitive.ObjectID  `json:"user_id"`
+	Text         string              `json:"text"`
+	Files        []string            `json:"files"`
+	Late         bool                `json:"late"`
+	Score        *int                `json:"score"`
+	FinalScore   *int                `json:"final_score"`
+	Feedback     string              `json:"feedback"`
+	GradedAt     *primitive.DateTime `json:"graded_at"`
+}
+
+func submissionResponseOf(submission models.Submission) submissionResponse {
+	return submissionResponse{
+		Id:           submission.Id,
+		Date:         submission.Date,
+		AssignmentID: submission.AssignmentID,
+		CourseID:     submission.CourseID,
+		UserID:       submission.UserID,
+		Text:         submission.Text,
+		Files:        submission.Files,
+		Late:         submission.Late,
+		Score:        submission.Score,
+		FinalScore:   submission.FinalScore,
+		Feedback:     submission.Feedback,
+		GradedAt:     submission.GradedAt,
+	}
+}
+
+func SubmitAssignment(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	assignment, ok := assignmentFromParam(c, course)
+	if !ok {
+		return
+	}
+
+	var submission submitAssignmentInput
+	if !bindJSON(c, &submission) {
+		return
+	}
+
+	if submission.Text == "" && len(submission.Files) == 0 {
+		apperror.Respond(c, apperror.Validation("empty_submission", "Submission must contain text or files"))
+		return
+	}
+
+	enrolled, err := isEnrolled(userID.(primitive.ObjectID), course.Id)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if !enrolled {
+		apperror.Respond(c, apperror.Forbidden("not_enrolled", "User is not enrolled in this course"))
+		return
+	}
+
+	now := time.Now()
+	late := assignment.DueDate != 0 && now.After(assignment.DueDate.Time())
+	if late && !assignment.AllowLate {
+		apperror.Respond(c, apperror.Forbidden("past_due_date", "The due date for this assignment has passed"))
+		return
+	}
+
+	result, err := submitAssignment(models.Submission{
+		Date:         primitive.NewDateTimeFromTime(now),
+		AssignmentID: assignment.Id,
+		CourseID:     course.Id,
+		UserID:       userID.(primitive.ObjectID),
+		Text:         submission.Text,
+		Files:        submission.Files,
+		Late:         late,
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, submissionResponseOf(*result))
+}
+
+// submitAssignment stores the learner's submission, replacing a previous
+// one as long as it has not been graded yet.
+func submitAssignment(submission models.Submission) (*models.Submission, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SubmissionCollection)
+	// A graded submission does not match the filter, so the upsert tries to
+	// insert a second one and fails on the unique index instead of
+	// overwriting what was graded.
+	filter := bson.M{
+		"course_id":     submission.CourseID,
+		"assignment_id": submission.AssignmentID,
+		"user_id":       submission.UserID,
+		"graded_at":     nil,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"date":  submission.Date,
+			"text":  submission.Text,
+			"files": submission.Files,
+			"late":  submission.Late,
+		},
+		"$setOnInsert": bson.M{
+			"_id":         primitive.NewObjectID(),
+			"score":       nil,
+			"final_score": nil,
+			"feedback":    "",
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var result models.Submission
+	err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&result)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errAlreadyGraded
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func GetAssignmentSubmissions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	assignment, ok := assignmentFromParam(c, course)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"course_id": course.Id, "assignment_id": assignment.Id}
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		filter["user_id"] = userID
+	}
+
+	submissions, err := findSubmissions(filter)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(submissions, submissionResponseOf))
+}
+
+type gradeSubmissionInput struct {
+	Score    *int   `json:"score" binding:"required"`
+	Feedback string `json:"feedback" binding:"max=5000"`
+}
+
+func GradeSubmission(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	submissionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_submission_id", "Invalid submission ID"))
+		return
+	}
+
+	var grade gradeSubmissionInput
+	if !bindJSON(c, &grade) {
+		return
+	}
+	submission, err := getSubmissionByID(submissionID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("submission_not_found", "Submission not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	course, err := getCourseByID(submission.CourseID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	assignment := findAssignment(course, submission.AssignmentID)
+	if assignment == nil {
+		apperror.Respond(c, apperror.NotFound("assignment_not_found", "Assignment no longer exists"))
+		return
+	}
+
+	if *grade.Score < 0 || (assignment.MaxScore > 0 && *grade.Score > assignment.MaxScore) {
+		apperror.Respond(c, apperror.Validation("invalid_score", "Score must be between 0 and the assignment's max score"))
+		return
+	}
+
+	result, err := gradeSubmission(submission, *assignment, *grade.Score, grade.Feedback)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, submissionResponseOf(*result))
+}
+
+func gradeSubmission(submission *models.Submission, assignment models.Assignment, score int, feedback string) (*models.Submission, error) {
+	finalScore := score
+	if submission.Late && assignment.LatePenalty > 0 {
+		finalScore = score * (100 - assignment.LatePenalty) / 100
+		if finalScore < 0 {
+			finalScore = 0
+		}
+	}
+	gradedAt := primitive.NewDateTimeFromTime(time.Now())
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SubmissionCollection)
+	update := bson.M{"$set": bson.M{
+		"score":       score,
+		"final_score": finalScore,
+		"feedback":    feedback,
+		"graded_at":   gradedAt,
+	}}
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": submission.Id}, update)
+	if err != nil {
+		return nil, err
+	}
+
+	submission.Score = &score
+	submission.FinalScore = &finalScore
+	submission.Feedback = feedback
+	submission.GradedAt = &gradedAt
+	return submission, nil
+}
+
+func getSubmissionByID(id primitive.ObjectID) (*models.Submission, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SubmissionCollection)
+	var submission models.Submission
+	err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&submission)
+	if err != nil {
+		return nil, err
+	}
+	return &submission, nil
+}
+
+func findSubmissions(filter bson.M) ([]models.Submission, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SubmissionCollection)
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	submissions := []models.Submission{}
+	if err = cursor.All(context.Background(), &submissions); err != nil {
+		return nil, err
+	}
+	return submissions, nil
+}
+
+func GetGradebook(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	rows, err := getGradebook(course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rows)
+}
+
+func getGradebook(course *models.Course) ([]gradebookRow, error) {
+	learners, err := getEnrolledUsers(course.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	submissions, err := findSubmissions(bson.M{"course_id": course.Id})
+	if err != nil {
+		return nil, err
+	}
+	byLearner := map[primitive.ObjectID]map[primitive.ObjectID]models.Submission{}
+	for _, submission := range submissions {
+		if byLearner[submission.UserID] == nil {
+			byLearner[submission.UserID] = map[primitive.ObjectID]models.Submission{}
+		}
+		byLearner[submission.UserID][submission.AssignmentID] = submission
+	}
+
+	rows := []gradebookRow{}
+	for _, learner := range learners {
+		row := gradebookRow{UserID: learner.Id, Email: learner.Email, Assignments: []gradebookAssignment{}, Quizzes: []gradebookQuiz{}}
+
+		for moduleIndex, module := range course.Modules {
+			for _, assignment := range module.Assignments {
+				entry := gradebookAssignment{
+					AssignmentID: assignment.Id,
+					Title:        assignment.Title,
+					Status:       submissionMissing,
+					MaxScore:     assignment.MaxScore,
+				}
+				if submission, ok := byLearner[learner.Id][assignment.Id]; ok {
+					entry.Status = submissionSubmitted
+					if submission.GradedAt != nil {
+						entry.Status = submissionGraded
+					}
+					entry.Late = submission.Late
+					entry.Score = submission.Score
+					entry.FinalScore = submission.FinalScore
+				}
+				row.Assignments = append(row.Assignments, entry)
+			}
+
+			if module.Quiz == nil {
+				continue
+			}
+			attempts, err := getQuizAttempts(learner.Id, course.Id, moduleIndex)
+			if err != nil {
+				return nil, err
+			}
+			summary := summarizeAttempts(*module.Quiz, attempts)
+			row.Quizzes = append(row.Quizzes, gradebookQuiz{
+				Module:    moduleIndex,
+				Attempts:  summary.AttemptsUsed,
+				KeptScore: summary.KeptScore,
+				Passed:    summary.Passed,
+			})
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func getEnrolledUsers(courseID primitive.ObjectID) ([]models.User, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "email", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{"cursos": courseID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	users := []models.User{}
+	if err = cursor.All(context.Background(), &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func assignmentFromParam(c *gin.Context, course *models.Course) (*models.Assignment, bool) {
+	assignmentID, err := primitive.ObjectIDFromHex(c.Param("assignment"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_assignment_id", "Invalid assignment ID"))
+		return nil, false
+	}
+
+	assignment := findAssignment(course, assignmentID)
+	if assignment == nil {
+		apperror.Respond(c, apperror.NotFound("assignment_not_found", "Assignment not found"))
+		return nil, false
+	}
+	return assignment, true
+}
+
+func findAssignment(course *models.Course, id primitive.ObjectID) *models.Assignment {
+	for i := range course.Modules {
+		for j := range course.Modules[i].Assignments {
+			if course.Modules[i].Assignments[j].Id == id {
+				return &course.Modules[i].Assignments[j]
+			}
+		}
+	}
+	return nil
+}
+
+// assignAssignmentIDs gives new assignments an ID while keeping the IDs of
+// the ones the client sent back, so submissions stay attached across edits.
+// Only IDs already in course, the stored version of the course being saved
+// or nil for a new one, are kept; any other ID a client sends is replaced,
+// so an assignment can never be tied to another course's submissions.
+func assignAssignmentIDs(modules []models.Module, course *models.Course) {
+	for i := range modules {
+		for j := range modules[i].Assignments {
+			id := modules[i].Assignments[j].Id
+			if id.IsZero() || course == nil || findAssignment(course, id) == nil {
+				modules[i].Assignments[j].Id = primitive.NewObjectID()
+			}
+		}
+	}
+}
+
+func validateAssignment(assignment models.Assignment) error {
+	if assignment.Title == "" {
+		return errors.New("title is required")
+	}
+	if assignment.MaxScore < 0 {
+		return errors.New("max_score cannot be negative")
+	}
+	if assignment.LatePenalty < 0 || assignment.LatePenalty > 100 {
+		return errors.New("late_penalty must be between 0 and 100")
+	}
+	return nil
+}
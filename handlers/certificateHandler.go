@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"github.com/phcarneirobc/free-learn/render"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type certificateResponse struct {
+	Id           primitive.ObjectID `json:"_id"`
+	Date         primitive.DateTime `json:"date"`
+	Code         string             `json:"code"`
+	CourseID     primitive.ObjectID `json:"course_id"`
+	LearnerName  string             `json:"learner_name"`
+	LearnerEmail string             `json:"learner_email"`
+	CourseName   string             `json:"course_name"`
+	CreatorName  string             `json:"creator_name"`
+}
+
+func certificateResponseOf(certificate models.Certificate) certificateResponse {
+	return certificateResponse{
+		Id:           certificate.Id,
+		Date:         certificate.Date,
+		Code:         certificate.Code,
+		CourseID:     certificate.CourseID,
+		LearnerName:  certificate.LearnerName,
+		LearnerEmail: certificate.LearnerEmail,
+		CourseName:   certificate.CourseName,
+		CreatorName:  certificate.CreatorName,
+	}
+}
+
+// issuedCertificate is the response for a certificate that may not have
+// been issued.
+func issuedCertificate(certificate *models.Certificate) *certificateResponse {
+	if certificate == nil {
+		return nil
+	}
+	response := certificateResponseOf(*certificate)
+	return &response
+}
+
+func GetUserCertificates(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	certificates, err := getUserCertificates(userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(certificates, certificateResponseOf))
+}
+
+func getUserCertificates(userID primitive.ObjectID) ([]models.Certificate, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CertificateCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}})
+	cursor, err := collection.Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	certificates := []models.Certificate{}
+	if err = cursor.All(context.Background(), &certificates); err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+func DownloadCertificate(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	certificateID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_certificate_id", "Invalid certificate ID"))
+		return
+	}
+
+	certificate, err := findCertificate(bson.M{"_id": certificateID, "user_id": userID})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("certificate_not_found", "Certificate not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	pdf, err := render.CertificatePDF(render.CertificateData{
+		LearnerName: certificate.LearnerName,
+		CourseName:  certificate.CourseName,
+		CreatorName: certificate.CreatorName,
+		IssuedAt:    certificate.Date.Time(),
+		Code:        certificate.Code,
+		VerifyURL:   certificateVerifyURL(certificate.Code),
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="certificate-`+certificate.Code+`.pdf"`)
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
+// certificateVerification is what anyone holding a verification code may
+// learn about the certificate; the learner's email is left out.
+type certificateVerification struct {
+	Valid       bool               `json:"valid"`
+	Code        string             `json:"code"`
+	LearnerName string             `json:"learner_name"`
+	CourseID    primitive.ObjectID `json:"course_id"`
+	CourseName  string             `json:"course_name"`
+	CreatorName string             `json:"creator_name"`
+	IssuedAt    primitive.DateTime `json:"issued_at"`
+}
+
+// VerifyCertificate is public so that anyone given a verification code, such
+// as an employer, can confirm the certificate is genuine.
+func VerifyCertificate(c *gin.Context) {
+	code := normalizeCertificateCode(c.Param("code"))
+
+	certificate, err := findCertificate(bson.M{"code": code})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("certificate_not_found", "Certificate not found").With("valid", false))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, certificateVerification{
+		Valid:       true,
+		Code:        certificate.Code,
+		LearnerName: certificate.LearnerName,
+		CourseID:    certificate.CourseID,
+		CourseName:  certificate.CourseName,
+		CreatorName: certificate.CreatorName,
+		IssuedAt:    certificate.Date,
+	})
+}
+
+func findCertificate(filter bson.M) (*models.Certificate, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CertificateCollection)
+	var certificate models.Certificate
+	err := collection.FindOne(context.Background(), filter).Decode(&certificate)
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// issueCertificate returns the user's certificate for a completed course,
+// creating it the first time. The learner and course details are copied in
+// so the certificate stays valid if either is edited later.
+func issueCertificate(userID primitive.ObjectID, course *models.Course) (*models.Certificate, error) {
+	existing, err := findCertificate(bson.M{"user_id": userID, "course_id": course.Id})
+	if err == nil {
+		return existing, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	learner, err := getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	creatorName := ""
+	creator, err := getUserByID(course.CreatorID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if creator != nil {
+		creatorName = displayName(creator)
+	}
+
+	code, err := newCertificateCode()
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := models.Certificate{
+		Id:           primitive.NewObjectID(),
+		Date:         primitive.NewDateTimeFromTime(time.Now()),
+		Code:         code,
+		UserID:       userID,
+		CourseID:     course.Id,
+		LearnerName:  displayName(learner),
+		LearnerEmail: learner.Email,
+		CourseName:   course.Name,
+		CreatorName:  creatorName,
+	}
+
+	_, err = db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.CertificateCollection, certificate)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request issued it first; the unique index on
+		// user_id and course_id keeps that one.
+		return findCertificate(bson.M{"user_id": userID, "course_id": course.Id})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// issueCertificateIfCompleted issues the certificate once status reports the
+// course as completed and returns nil otherwise.
+func issueCertificateIfCompleted(userID primitive.ObjectID, course *models.Course, status courseStatus) (*models.Certificate, error) {
+	if !status.Completed {
+		return nil, nil
+	}
+	return issueCertificate(userID, course)
+}
+
+// newCertificateCode returns a random code such as "K3FQ-7ZP2-MWXA-4CDE",
+// avoiding characters that are easy to misread when typed from paper.
+func newCertificateCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return normalizeCertificateCode(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)), nil
+}
+
+// normalizeCertificateCode upper-cases the code and regroups it with dashes,
+// so codes typed in lower case or without dashes still verify.
+func normalizeCertificateCode(code string) string {
+	var plain strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			plain.WriteRune(r)
+		}
+	}
+
+	raw := plain.String()
+	groups := []string{}
+	for i := 0; i < len(raw); i += 4 {
+		end := i + 4
+		if end > len(raw) {
+			end = len(raw)
+		}
+		groups = append(groups, raw[i:end])
+	}
+	return strings.Join(groups, "-")
+}
+
+func certificateVerifyURL(code string) string {
+	base := strings.TrimRight(os.Getenv("PUBLIC_URL"), "/")
+	if base == "" {
+		return ""
+	}
+	return base + "/api/v1/certificate-verifications/" + code
+}
@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	cohortEnrolled   = "enrolled"
+	cohortWaitlisted = "waitlisted"
+)
+
+var errAlreadyInCohort = apperror.Conflict("already_in_cohort", "User already belongs to a cohort of this course")
+
+// cohortSummary is what learners see of a cohort: its schedule and how full
+// it is, but not who is in it.
+type cohortSummary struct {
+	Id               primitive.ObjectID `json:"_id"`
+	CourseID         primitive.ObjectID `json:"course_id"`
+	Name             string             `json:"name"`
+	StartDate        primitive.DateTime `json:"start_date"`
+	EndDate          primitive.DateTime `json:"end_date"`
+	EnrollmentOpens  primitive.DateTime `json:"enrollment_opens"`
+	EnrollmentCloses primitive.DateTime `json:"enrollment_closes"`
+	Capacity         int                `json:"capacity"`
+	Enrolled         int                `json:"enrolled"`
+	Waitlisted       int                `json:"waitlisted"`
+}
+
+func cohortSummaryOf(cohort models.Cohort) cohortSummary {
+	return cohortSummary{
+		Id:               cohort.Id,
+		CourseID:         cohort.CourseID,
+		Name:             cohort.Name,
+		StartDate:        cohort.StartDate,
+		EndDate:          cohort.EndDate,
+		EnrollmentOpens:  cohort.EnrollmentOpens,
+		EnrollmentCloses: cohort.EnrollmentCloses,
+		Capacity:         cohort.Capacity,
+		Enrolled:         len(cohort.Members),
+		Waitlisted:       len(cohort.Waitlist),
+	}
+}
+
+type rosterEntry struct {
+	UserID primitive.ObjectID `json:"user_id"`
+	Email  string             `json:"email"`
+}
+
+type cohortRoster struct {
+	Cohort   cohortSummary `json:"cohort"`
+	Members  []rosterEntry `json:"members"`
+	Waitlist []rosterEntry `json:"waitlist"`
+}
+
+// cohortEnrollment tells whether the learner got a seat or, when waitlisted,
+// their place in line.
+type cohortEnrollment struct {
+	Status   string `json:"status"`
+	Position int    `json:"position,omitempty"`
+}
+
+// cohortInput is the schedule a course creator sets for a cohort. Members
+// and the waitlist are only changed by enrolling and leaving.
+type cohortInput struct {
+	Name             string             `json:"name" binding:"required,max=200"`
+	StartDate        primitive.DateTime `json:"start_date" binding:"required"`
+	EndDate          primitive.DateTime `json:"end_date"`
+	EnrollmentOpens  primitive.DateTime `json:"enrollment_opens"`
+	EnrollmentCloses primitive.DateTime `json:"enrollment_closes"`
+	Capacity         int                `json:"capacity" binding:"min=0"`
+}
+
+func PostCohort(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	var input cohortInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if err := validateCohort(input); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	cohort := models.Cohort{
+		Id:               primitive.NewObjectID(),
+		Date:             primitive.NewDateTimeFromTime(time.Now()),
+		CourseID:         course.Id,
+		Name:             input.Name,
+		StartDate:        input.StartDate,
+		EndDate:          input.EndDate,
+		EnrollmentOpens:  input.EnrollmentOpens,
+		EnrollmentCloses: input.EnrollmentCloses,
+		Capacity:         input.Capacity,
+		Members:          []primitive.ObjectID{},
+		Waitlist:         []primitive.ObjectID{},
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.CohortCollection, cohort)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cohortSummaryOf(cohort))
+}
+
+func validateCohort(cohort cohortInput) error {
+	if cohort.EndDate != 0 && cohort.EndDate < cohort.StartDate {
+		return invalidField("end_date", "gtefield", "must be after start_date")
+	}
+	if cohort.EnrollmentOpens != 0 && cohort.EnrollmentCloses != 0 && cohort.EnrollmentCloses < cohort.EnrollmentOpens {
+		return invalidField("enrollment_closes", "gtefield", "must be after enrollment_opens")
+	}
+	return nil
+}
+
+func GetCourseCohorts(c *gin.Context) {
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	cohorts, err := findCohorts(bson.M{"course_id": course.Id})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(cohorts, cohortSummaryOf))
+}
+
+func findCohorts(filter bson.M) ([]models.Cohort, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CohortCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "start_date", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	cohorts := []models.Cohort{}
+	if err = cursor.All(context.Background(), &cohorts); err != nil {
+		return nil, err
+	}
+	return cohorts, nil
+}
+
+func EnrollInCohort(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	cohort, ok := cohortFromParam(c)
+	if !ok {
+		return
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	if (cohort.EnrollmentOpens != 0 && now < cohort.EnrollmentOpens) || (cohort.EnrollmentCloses != 0 && now > cohort.EnrollmentCloses) {
+		apperror.Respond(c, apperror.Forbidden("enrollment_closed", "Enrollment for this cohort is not open"))
+		return
+	}
+
+	course, err := getCourseByID(cohort.CourseID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if course.Archived {
+		apperror.Respond(c, apperror.Forbidden("course_archived", "Course is archived and no longer accepts enrollments"))
+		return
+	}
+
+	missing, err := missingPrerequisites(userID.(primitive.ObjectID), course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if len(missing) > 0 {
+		apperror.Respond(c, errPrerequisitesMissing(missing))
+		return
+	}
+
+	status, position, err := enrollInCohort(userID.(primitive.ObjectID), cohort)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	response := cohortEnrollment{Status: status}
+	if status == cohortWaitlisted {
+		response.Position = position
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// enrollInCohort takes a seat if one is left and nobody is waiting for one,
+// checking both in the same update that adds the member so concurrent
+// requests cannot overfill the cohort or jump the waitlist. Otherwise the
+// user joins the waitlist and gets their position.
+func enrollInCohort(userID primitive.ObjectID, cohort *models.Cohort) (string, int, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CohortCollection)
+
+	count, err := collection.CountDocuments(context.Background(), bson.M{
+		"course_id": cohort.CourseID,
+		"$or":       []bson.M{{"members": userID}, {"waitlist": userID}},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if count > 0 {
+		return "", 0, errAlreadyInCohort
+	}
+
+	filter := seatFilter(cohort)
+	filter["waitlist.0"] = bson.M{"$exists": false}
+	result, err := collection.UpdateOne(context.Background(), filter, bson.M{"$addToSet": bson.M{"members": userID}})
+	if err != nil {
+		return "", 0, err
+	}
+	if result.ModifiedCount > 0 {
+		return cohortEnrolled, 0, enrollInCourse(userID, cohort.CourseID)
+	}
+
+	var updated models.Cohort
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = collection.FindOneAndUpdate(context.Background(), bson.M{"_id": cohort.Id}, bson.M{"$addToSet": bson.M{"waitlist": userID}}, opts).Decode(&updated)
+	if err != nil {
+		return "", 0, err
+	}
+	return cohortWaitlisted, len(updated.Waitlist), nil
+}
+
+// seatFilter matches the cohort while it has a free seat.
+func seatFilter(cohort *models.Cohort) bson.M {
+	filter := bson.M{"_id": cohort.Id}
+	if cohort.Capacity > 0 {
+		filter["$expr"] = bson.M{"$lt": bson.A{bson.M{"$size": "$members"}, cohort.Capacity}}
+	}
+	return filter
+}
+
+func enrollInCourse(userID, courseID primitive.ObjectID) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": userID}, bson.M{"$addToSet": bson.M{"cursos": courseID}})
+	return err
+}
+
+func LeaveCohort(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	cohort, ok := cohortFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := leaveCohort(userID.(primitive.ObjectID), cohort); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left cohort successfully"})
+}
+
+// leaveCohort removes the user from the cohort and, if that freed a seat,
+// gives it to someone on the waitlist.
+func leaveCohort(userID primitive.ObjectID, cohort *models.Cohort) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CohortCollection)
+	update := bson.M{"$pull": bson.M{"members": userID, "waitlist": userID}}
+	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": cohort.Id, "members": userID}, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		_, err = collection.UpdateOne(context.Background(), bson.M{"_id": cohort.Id}, update)
+		return err
+	}
+
+	return promoteFromWaitlist(cohort.Id)
+}
+
+// promoteFromWaitlist gives a free seat to the first person on the
+// waitlist who could still enroll: the course is not archived and they
+// meet its prerequisites. Like enrollInCohort, it checks capacity in the
+// update that moves them, so an enrollment racing for the same seat cannot
+// overfill the cohort.
+func promoteFromWaitlist(cohortID primitive.ObjectID) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CohortCollection)
+	var cohort models.Cohort
+	if err := collection.FindOne(context.Background(), bson.M{"_id": cohortID}).Decode(&cohort); err != nil {
+		return err
+	}
+
+	course, err := getCourseByID(cohort.CourseID)
+	if err != nil {
+		return err
+	}
+	if course.Archived {
+		return nil
+	}
+
+	for _, candidate := range cohort.Waitlist {
+		missing, err := missingPrerequisites(candidate, course)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			continue
+		}
+
+		filter := seatFilter(&cohort)
+		filter["waitlist"] = candidate
+		result, err := collection.UpdateOne(context.Background(), filter, bson.M{
+			"$pull":     bson.M{"waitlist": candidate},
+			"$addToSet": bson.M{"members": candidate},
+		})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			// The seat was taken or the candidate left the waitlist.
+			continue
+		}
+		return enrollInCourse(candidate, cohort.CourseID)
+	}
+	return nil
+}
+
+func GetCohortRoster(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	cohort, ok := cohortFromParam(c)
+	if !ok {
+		return
+	}
+
+	course, err := getCourseByID(cohort.CourseID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	members, err := rosterEntries(cohort.Members)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	waitlist, err := rosterEntries(cohort.Waitlist)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cohortRoster{Cohort: cohortSummaryOf(*cohort), Members: members, Waitlist: waitlist})
+}
+
+// rosterEntries resolves user IDs to roster entries, keeping the order of
+// ids so the waitlist reads first come, first served.
+func rosterEntries(ids []primitive.ObjectID) ([]rosterEntry, error) {
+	entries := []rosterEntry{}
+	if len(ids) == 0 {
+		return entries, nil
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	cursor, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var users []models.User
+	if err = cursor.All(context.Background(), &users); err != nil {
+		return nil, err
+	}
+
+	emails := map[primitive.ObjectID]string{}
+	for _, user := range users {
+		emails[user.Id] = user.Email
+	}
+	for _, id := range ids {
+		entries = append(entries, rosterEntry{UserID: id, Email: emails[id]})
+	}
+	return entries, nil
+}
+
+func cohortFromParam(c *gin.Context) (*models.Cohort, bool) {
+	cohortID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_cohort_id", "Invalid cohort ID"))
+		return nil, false
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CohortCollection)
+	var cohort models.Cohort
+	err = collection.FindOne(context.Background(), bson.M{"_id": cohortID}).Decode(&cohort)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("cohort_not_found", "Cohort not found"))
+			return nil, false
+		}
+		apperror.Respond(c, err)
+		return nil, false
+	}
+
+	return &cohort, true
+}
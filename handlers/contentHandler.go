@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	models "github.com/phcarneirobc/free-learn/model"
+	"github.com/phcarneirobc/free-learn/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func GetCourseDescription(c *gin.Context) {
+	format, ok := contentFormat(c)
+	if !ok {
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	writeContent(c, course.Id, "description", course.Description, "", format)
+}
+
+func GetLessonContent(c *gin.Context) {
+	format, ok := contentFormat(c)
+	if !ok {
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	lesson, moduleIndex, lessonIndex, ok := lessonFromParams(c, course)
+	if !ok {
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	if !requireModuleAccess(c, userID.(primitive.ObjectID), course, moduleIndex) {
+		return
+	}
+
+	field := fmt.Sprintf("lesson:%d:%d", moduleIndex, lessonIndex)
+	writeContent(c, course.Id, field, lesson.Content, lesson.Link, format)
+}
+
+// hideLessonContent strips the content and link of every lesson in the
+// courses, except on courses created by viewerID, so lesson bodies are only
+// served by GetLessonContent once the module is unlocked.
+func hideLessonContent(courses []models.Course, viewerID primitive.ObjectID) {
+	for i := range courses {
+		if !viewerID.IsZero() && courses[i].CreatorID == viewerID {
+			continue
+		}
+		modules := make([]models.Module, len(courses[i].Modules))
+		for j, module := range courses[i].Modules {
+			lessons := make([]models.Lesson, len(module.Lessons))
+			for k, lesson := range module.Lessons {
+				lessons[k] = models.Lesson{Name: lesson.Name}
+			}
+			module.Lessons = lessons
+			modules[j] = module
+		}
+		courses[i].Modules = modules
+	}
+}
+
+func contentFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", render.FormatMarkdown)
+	if format != render.FormatMarkdown && format != render.FormatHTML {
+		apperror.Respond(c, apperror.Validation("invalid_format", "Query parameter 'format' must be 'markdown' or 'html'"))
+		return "", false
+	}
+	return format, true
+}
+
+type renderedContent struct {
+	Format  string `json:"format"`
+	Content string `json:"content"`
+	Link    string `json:"link,omitempty"`
+}
+
+func writeContent(c *gin.Context, courseID primitive.ObjectID, field, source, link, format string) {
+	content := source
+	if format == render.FormatHTML {
+		html, err := render.HTMLCache.HTML(courseID.Hex(), field, source)
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		content = html
+	}
+
+	c.JSON(http.StatusOK, renderedContent{Format: format, Content: content, Link: link})
+}
+
+// courseFromParam loads the course named by the ":id" route parameter,
+// writing the error response itself when it cannot.
+func courseFromParam(c *gin.Context) (*models.Course, bool) {
+	courseObjectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
+		return nil, false
+	}
+
+	course, err := getCourseByID(courseObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("course_not_found", "Course not found"))
+			return nil, false
+		}
+		apperror.Respond(c, err)
+		return nil, false
+	}
+
+	return course, true
+}
+
+// lessonFromParams resolves the ":module" and ":lesson" route parameters,
+// which are zero-based positions inside the course.
+func lessonFromParams(c *gin.Context, course *models.Course) (*models.Lesson, int, int, bool) {
+	moduleIndex, ok := moduleIndexFromParam(c, course)
+	if !ok {
+		return nil, 0, 0, false
+	}
+
+	lessons := course.Modules[moduleIndex].Lessons
+	lessonIndex, err := strconv.Atoi(c.Param("lesson"))
+	if err != nil || lessonIndex < 0 || lessonIndex >= len(lessons) {
+		apperror.Respond(c, apperror.NotFound("lesson_not_found", "Lesson not found"))
+		return nil, 0, 0, false
+	}
+
+	return &lessons[lessonIndex], moduleIndex, lessonIndex, true
+}
+
+func moduleIndexFromParam(c *gin.Context, course *models.Course) (int, bool) {
+	moduleIndex, err := strconv.Atoi(c.Param("module"))
+	if err != nil || moduleIndex < 0 || moduleIndex >= len(course.Modules) {
+		apperror.Respond(c, apperror.NotFound("module_not_found", "Module not found"))
+		return 0, false
+	}
+	return moduleIndex, true
+}
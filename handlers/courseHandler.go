@@ -1,15 +1,23 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"reflect"
 	"time"
 
 	"net/http"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
 	"github.com/phcarneirobc/free-learn/db"
 	models "github.com/phcarneirobc/free-learn/model"
+	"github.com/phcarneirobc/free-learn/render"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -18,15 +26,20 @@ import (
 func SearchCourses(c *gin.Context) {
 	query := c.Query("q")
 	if query == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter 'q' is required"})
+		apperror.Respond(c, apperror.Validation("query_required", "Query parameter 'q' is required"))
 		return
 	}
 	courses, err := searchCoursesByQuery(query)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, courses)
+	responses, err := courseResponses(courses, primitive.NilObjectID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, responses)
 }
 
 func searchCoursesByQuery(query string) ([]models.Course, error) {
@@ -36,6 +49,7 @@ func searchCoursesByQuery(query string) ([]models.Course, error) {
 			{"name": bson.M{"$regex": query, "$options": "i"}},
 			{"description": bson.M{"$regex": query, "$options": "i"}},
 		},
+		"archived": bson.M{"$ne": true},
 	}
 	cursor, err := collection.Find(context.Background(), filter)
 	if err != nil {
@@ -50,29 +64,112 @@ func searchCoursesByQuery(query string) ([]models.Course, error) {
 	return courses, nil
 }
 
+// courseInput is what a professor may set on a course. The ID, creator,
+// ratings and archived flag are only ever set by the server.
+type courseInput struct {
+	Name        string          `json:"name" binding:"required,max=200"`
+	Description string          `json:"description" binding:"max=5000"`
+	Image       string          `json:"image" binding:"omitempty,http_url,max=2048"`
+	Link        string          `json:"link" binding:"omitempty,http_url,max=2048"`
+	Modules     []models.Module `json:"modules" binding:"max=100,dive"`
+
+	Prerequisites    []primitive.ObjectID `json:"prerequisites"`
+	SequentialGating bool                 `json:"sequential_gating"`
+}
+
+// courseResponse is a course as clients see it, with the public profile of
+// its creator.
+type courseResponse struct {
+	Id          primitive.ObjectID `json:"_id"`
+	Date        primitive.DateTime `json:"date"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Image       string             `json:"image"`
+	Link        string             `json:"link"`
+	Modules     []models.Module    `json:"modules"`
+	CreatorID   primitive.ObjectID `json:"creator_id"`
+	Creator     *creatorSummary    `json:"creator,omitempty"`
+	Ratings     []models.Rating    `json:"ratings"`
+
+	Prerequisites    []primitive.ObjectID `json:"prerequisites"`
+	SequentialGating bool                 `json:"sequential_gating"`
+	Archived         bool                 `json:"archived"`
+}
+
+func courseResponseOf(course models.Course) courseResponse {
+	return courseResponse{
+		Id:               course.Id,
+		Date:             course.Date,
+		Name:             course.Name,
+		Description:      course.Description,
+		Image:            course.Image,
+		Link:             course.Link,
+		Modules:          course.Modules,
+		CreatorID:        course.CreatorID,
+		Ratings:          course.Ratings,
+		Prerequisites:    course.Prerequisites,
+		SequentialGating: course.SequentialGating,
+		Archived:         course.Archived,
+	}
+}
+
+// courseResponses prepares courses for viewerID: quiz answers and lesson
+// content are hidden unless the viewer created the course, and creators
+// are filled in.
+func courseResponses(courses []models.Course, viewerID primitive.ObjectID) ([]courseResponse, error) {
+	hideQuizAnswers(courses, viewerID)
+	hideLessonContent(courses, viewerID)
+	responses := responsesOf(courses, courseResponseOf)
+	if err := attachCreators(responses); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// ratingInput is a review; the author is always the logged in user.
+type ratingInput struct {
+	Score  int    `json:"score" binding:"min=1,max=5"`
+	Review string `json:"review" binding:"max=2000"`
+}
+
 func PostCourse(c *gin.Context) {
-	var reading models.Course
-	if err := c.BindJSON(&reading); err != nil {
-		c.JSON(400, gin.H{"message": "Bad Request"})
+	var reading courseInput
+	if !bindJSON(c, &reading) {
+		return
+	}
+
+	if err := validateModules(reading.Modules); err != nil {
+		apperror.Respond(c, invalidField("modules", "content", err.Error()))
+		return
+	}
+
+	if err := validatePrerequisites(primitive.NilObjectID, reading.Prerequisites); err != nil {
+		apperror.Respond(c, err)
 		return
 	}
 
 	userID, exists := c.Get("userID")
 	if !exists {
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
 		return
 	}
 
 	object, err := postCourse(reading, userID.(primitive.ObjectID))
 	if err != nil {
-		c.JSON(500, gin.H{"message": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
 
-	c.JSON(200, object)
+	responses, err := courseResponses([]models.Course{object}, userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(200, responses[0])
 }
 
-func postCourse(read models.Course, creatorID primitive.ObjectID) (models.Course, error) {
+func postCourse(read courseInput, creatorID primitive.ObjectID) (models.Course, error) {
+	assignAssignmentIDs(read.Modules, nil)
 	toInsert := models.Course{
 		Id:          primitive.NewObjectID(),
 		Date:        primitive.NewDateTimeFromTime(time.Now()),
@@ -82,6 +179,10 @@ func postCourse(read models.Course, creatorID primitive.ObjectID) (models.Course
 		Link:        read.Link,
 		Modules:     read.Modules,
 		CreatorID:   creatorID,
+		Ratings:     []models.Rating{},
+
+		Prerequisites:    read.Prerequisites,
+		SequentialGating: read.SequentialGating,
 	}
 
 	_, err := db.InsertOne(
@@ -100,22 +201,29 @@ func GetCourseByID(c *gin.Context) {
 
 	courseObjectID, err := primitive.ObjectIDFromHex(courseID)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid course ID"})
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
 		return
 	}
 
 	result, err := getCourseByID(courseObjectID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to get course by ID", "details": err.Error()})
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("course_not_found", "Course not found"))
+			return
+		}
+		apperror.Respond(c, err)
 		return
 	}
 
-	if result == nil {
-		c.JSON(404, gin.H{"error": "Course not found"})
+	userID, _ := c.Get("userID")
+	viewerID, _ := userID.(primitive.ObjectID)
+	responses, err := courseResponses([]models.Course{*result}, viewerID)
+	if err != nil {
+		apperror.Respond(c, err)
 		return
 	}
 
-	c.JSON(200, result)
+	c.JSON(200, responses[0])
 }
 
 func getCourseByID(id primitive.ObjectID) (*models.Course, error) {
@@ -131,11 +239,16 @@ func getCourseByID(id primitive.ObjectID) (*models.Course, error) {
 func GetAllCourses(c *gin.Context) {
 	readings, err := getAllCourses()
 	if err != nil {
-		c.JSON(500, gin.H{"message": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
 
-	c.JSON(200, readings)
+	responses, err := courseResponses(readings, primitive.NilObjectID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(200, responses)
 }
 
 func getAllCourses() ([]models.Course, error) {
@@ -164,50 +277,249 @@ func getAllCourses() ([]models.Course, error) {
 
 func readAllCourse(client *mongo.Client, ctx context.Context, dataBase, col string) (*mongo.Cursor, error) {
 	collection := client.Database(dataBase).Collection(col)
-	cur, err := collection.Find(ctx, bson.M{})
+	cur, err := collection.Find(ctx, bson.M{"archived": bson.M{"$ne": true}})
 	return cur, err
 }
 
 func UpdateCourseValue(c *gin.Context) {
 	courseID := c.Param("id")
 
-	var courseUpdate struct {
-		Name        string          `json:"name"`
-		Description string          `json:"description"`
-		Link        string          `json:"link"`
-		Image       string          `json:"image"`
-		Modules     []models.Module `json:"modules"`
+	var courseUpdate courseInput
+	if !bindJSON(c, &courseUpdate) {
+		return
 	}
 
-	if err := c.BindJSON(&courseUpdate); err != nil {
-		c.JSON(400, gin.H{"error": "Failed to bind JSON data"})
+	if err := validateModules(courseUpdate.Modules); err != nil {
+		apperror.Respond(c, invalidField("modules", "content", err.Error()))
 		return
 	}
 
 	courseObjectID, err := primitive.ObjectIDFromHex(courseID)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid course ID"})
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, err := getCourseByID(courseObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("course_not_found", "Course not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	if err := validatePrerequisites(courseObjectID, courseUpdate.Prerequisites); err != nil {
+		apperror.Respond(c, err)
 		return
 	}
 
-	err = updateCourseValue(courseObjectID, courseUpdate.Name, courseUpdate.Description, courseUpdate.Link, courseUpdate.Image, courseUpdate.Modules)
+	err = updateCourseValue(course, courseUpdate)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update course", "details": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
+	render.HTMLCache.Invalidate(courseObjectID.Hex())
 
 	c.JSON(200, gin.H{"message": "Course updated successfully"})
 }
 
-func updateCourseValue(courseID primitive.ObjectID, name, description, link, image string, modules []models.Module) error {
-	updateData := bson.M{
-		"name":        name,
-		"description": description,
-		"link":        link,
-		"image":       image,
-		"modules":     modules,
+func updateCourseValue(course *models.Course, update courseInput) error {
+	assignAssignmentIDs(update.Modules, course)
+	return updateCourseByID(course.Id, courseFields(update))
+}
+
+// courseFields maps a course input to the fields of the course document.
+func courseFields(input courseInput) bson.M {
+	return bson.M{
+		"name":              input.Name,
+		"description":       input.Description,
+		"link":              input.Link,
+		"image":             input.Image,
+		"modules":           input.Modules,
+		"prerequisites":     input.Prerequisites,
+		"sequential_gating": input.SequentialGating,
 	}
-	return updateCourseByID(courseID, updateData)
+}
+
+func courseInputOf(course models.Course) courseInput {
+	input := courseInput{
+		Name:             course.Name,
+		Description:      course.Description,
+		Image:            course.Image,
+		Link:             course.Link,
+		Modules:          course.Modules,
+		Prerequisites:    course.Prerequisites,
+		SequentialGating: course.SequentialGating,
+	}
+	// JSON Patch cannot append to null, so missing lists become empty ones.
+	if input.Modules == nil {
+		input.Modules = []models.Module{}
+	}
+	if input.Prerequisites == nil {
+		input.Prerequisites = []primitive.ObjectID{}
+	}
+	return input
+}
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+
+	// maxPatchSize is MongoDB's document size limit; no patch of a course
+	// that fits in a document needs more.
+	maxPatchSize = 16 << 20
+)
+
+// PatchCourse changes only the fields a patch touches and returns the
+// updated course. The patch is either a JSON Merge Patch (RFC 7396), also
+// accepted as application/json, or a JSON Patch (RFC 6902); both apply to
+// the course as courseInput shows it, and the result is validated like the
+// body of a PUT before anything is saved.
+func PatchCourse(c *gin.Context) {
+	courseObjectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, err := getCourseByID(courseObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("course_not_found", "Course not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+	if course.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	patch, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPatchSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apperror.Respond(c, apperror.RequestTooLarge("patch_too_large", fmt.Sprintf("The patch may not exceed %d bytes", maxPatchSize)))
+		return
+	}
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_body", err.Error()))
+		return
+	}
+
+	original := courseInputOf(*course)
+	patched, err := applyCoursePatch(c.ContentType(), original, patch)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if err := validate(&patched); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if err := validateModules(patched.Modules); err != nil {
+		apperror.Respond(c, invalidField("modules", "content", err.Error()))
+		return
+	}
+
+	assignAssignmentIDs(patched.Modules, course)
+	changes := changedCourseFields(original, patched)
+	if _, ok := changes["prerequisites"]; ok {
+		if err := validatePrerequisites(courseObjectID, patched.Prerequisites); err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+	}
+
+	if len(changes) > 0 {
+		if err := updateCourseByID(courseObjectID, changes); err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		render.HTMLCache.Invalidate(courseObjectID.Hex())
+	}
+
+	updated, err := getCourseByID(courseObjectID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	responses, err := courseResponses([]models.Course{*updated}, userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responses[0])
+}
+
+// applyCoursePatch applies patch, of the given media type, to course.
+// Patches may only touch the fields of courseInput; adding any other member
+// is refused rather than ignored.
+func applyCoursePatch(contentType string, course courseInput, patch []byte) (courseInput, error) {
+	document, err := json.Marshal(course)
+	if err != nil {
+		return courseInput{}, err
+	}
+
+	switch contentType {
+	case mergePatchType, "application/json":
+		document, err = jsonpatch.MergePatch(document, patch)
+	case jsonPatchType:
+		var operations jsonpatch.Patch
+		operations, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			document, err = operations.Apply(document)
+		}
+	default:
+		return courseInput{}, apperror.UnsupportedMediaType("unsupported_patch_type",
+			"Send a JSON Merge Patch as "+mergePatchType+" or a JSON Patch as "+jsonPatchType)
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return courseInput{}, apperror.Conflict("patch_test_failed", err.Error())
+	}
+	if err != nil {
+		return courseInput{}, apperror.Validation("invalid_patch", err.Error())
+	}
+
+	var patched courseInput
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		return courseInput{}, apperror.Validation("invalid_patch", err.Error())
+	}
+	return patched, nil
+}
+
+// changedCourseFields returns the fields of patched that differ from
+// original, so a patch never rewrites fields it left alone.
+func changedCourseFields(original, patched courseInput) bson.M {
+	before := courseFields(original)
+	changes := bson.M{}
+	for field, value := range courseFields(patched) {
+		if !reflect.DeepEqual(before[field], value) {
+			changes[field] = value
+		}
+	}
+	return changes
 }
 
 func updateCourseByID(id primitive.ObjectID, updateData bson.M) error {
@@ -221,21 +533,22 @@ func DeleteCourse(c *gin.Context) {
 
 	courseObjectID, err := primitive.ObjectIDFromHex(courseID)
 	if err != nil {
-		c.JSON(400, gin.H{"error": "Invalid course ID"})
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
 		return
 	}
 
 	userID, exists := c.Get("userID")
 	if !exists {
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
 		return
 	}
 
 	err = deleteCourse(userID.(primitive.ObjectID), courseObjectID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to delete course", "details": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
+	render.HTMLCache.Invalidate(courseObjectID.Hex())
 
 	c.JSON(200, gin.H{"message": "Course deleted successfully"})
 }
@@ -247,13 +560,13 @@ func deleteCourse(userID, courseID primitive.ObjectID) error {
 	err := courseCollection.FindOne(context.Background(), bson.M{"_id": courseID}).Decode(&course)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return errors.New("course not found")
+			return apperror.NotFound("course_not_found", "Course not found")
 		}
 		return err
 	}
 
 	if course.CreatorID != userID {
-		return errors.New("user is not the creator of the course")
+		return apperror.Forbidden("not_course_creator", "User is not the creator of the course")
 	}
 
 	_, err = courseCollection.DeleteOne(context.Background(), bson.M{"_id": courseID})
@@ -262,36 +575,26 @@ func deleteCourse(userID, courseID primitive.ObjectID) error {
 
 func RateCourse(c *gin.Context) {
 	courseID := c.Param("id")
-	var rating models.Rating
-	if err := c.ShouldBindJSON(&rating); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var input ratingInput
+	if !bindJSON(c, &input) {
 		return
 	}
 
 	userID, exists := c.Get("userID")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
-	}
-
-	if rating.UserID != userID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID in request body does not match authenticated user"})
-		return
-	}
-
-	if rating.Score < 1 || rating.Score > 5 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Score must be between 1 and 5"})
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
 		return
 	}
+	rating := models.Rating{UserID: userID.(primitive.ObjectID), Score: input.Score, Review: input.Review}
 
 	courseObjectID, err := primitive.ObjectIDFromHex(courseID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
 		return
 	}
 
 	if err := rateCourse(userID.(primitive.ObjectID), courseObjectID, rating); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
 
@@ -304,37 +607,61 @@ func rateCourse(userID, courseID primitive.ObjectID, rating models.Rating) error
 
 	err := courseCollection.FindOne(context.Background(), bson.M{"_id": courseID}).Decode(&course)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return apperror.NotFound("course_not_found", "Course not found")
+		}
 		return err
 	}
 
 	if course.CreatorID == userID {
-		return errors.New("professors cannot rate their own courses")
+		return apperror.Forbidden("own_course", "Professors cannot rate their own courses")
 	}
 
-	for _, existingRating := range course.Ratings {
-		if existingRating.UserID == userID {
-			return errors.New("user has already rated this course")
+	// Courses created without ratings store null, which $push refuses.
+	if course.Ratings == nil {
+		_, err = courseCollection.UpdateOne(context.Background(),
+			bson.M{"_id": courseID, "ratings": nil},
+			bson.M{"$set": bson.M{"ratings": []models.Rating{}}},
+		)
+		if err != nil {
+			return err
 		}
 	}
 
-	course.Ratings = append(course.Ratings, rating)
-	_, err = courseCollection.UpdateOne(context.Background(), bson.M{"_id": courseID}, bson.M{"$set": bson.M{"ratings": course.Ratings}})
-	return err
+	// The rating is only added if the user has none yet, checked in the
+	// same update so two submissions cannot both add one.
+	result, err := courseCollection.UpdateOne(context.Background(),
+		bson.M{"_id": courseID, "ratings.user_id": bson.M{"$ne": userID}},
+		bson.M{"$push": bson.M{"ratings": rating}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return apperror.Conflict("already_rated", "User has already rated this course")
+	}
+	return nil
 }
 
 func GetUserCourses(c *gin.Context) {
 	userID := c.Param("id")
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apperror.Respond(c, apperror.Validation("invalid_user_id", "Invalid user ID"))
 		return
 	}
 	courses, err := getUserCourses(objectID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apperror.Respond(c, err)
+		return
+	}
+	viewerID, _ := c.Get("userID")
+	responses, err := courseResponses(courses, viewerID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, courses)
+	c.JSON(http.StatusOK, responses)
 }
 
 func getUserCourses(userID primitive.ObjectID) ([]models.Course, error) {
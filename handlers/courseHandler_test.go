@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/phcarneirobc/free-learn/apperror"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func patchableCourse() courseInput {
+	return courseInputOf(models.Course{
+		Name:        "Go",
+		Description: "Learn Go",
+		Image:       "https://example.com/go.png",
+		Modules: []models.Module{{
+			Name:        "Basics",
+			Lessons:     []models.Lesson{{Name: "Hello", Content: "Hello, world"}},
+			Assignments: []models.Assignment{{Id: primitive.NewObjectID(), Title: "Exercise"}},
+		}},
+	})
+}
+
+func TestCoursePatchOnlyChangesSuppliedFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		changed     map[string]interface{}
+	}{
+		{"merge patch", mergePatchType, `{"name": "Go in depth"}`, map[string]interface{}{"name": "Go in depth"}},
+		{"merge patch as application/json", "application/json", `{"sequential_gating": true}`, map[string]interface{}{"sequential_gating": true}},
+		{"merge patch removing a field", mergePatchType, `{"description": null}`, map[string]interface{}{"description": ""}},
+		{"json patch", jsonPatchType, `[{"op": "test", "path": "/name", "value": "Go"}, {"op": "replace", "path": "/image", "value": "https://example.com/new.png"}]`,
+			map[string]interface{}{"image": "https://example.com/new.png"}},
+		{"json patch on a module", jsonPatchType, `[{"op": "replace", "path": "/modules/0/name", "value": "Getting started"}]`, nil},
+		{"empty merge patch", mergePatchType, `{}`, map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := patchableCourse()
+			patched, err := applyCoursePatch(tt.contentType, original, []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes := changedCourseFields(original, patched)
+			if tt.changed == nil {
+				if len(changes) != 1 || changes["modules"] == nil {
+					t.Fatalf("changes = %v, want only modules", changes)
+				}
+				if name := patched.Modules[0].Name; name != "Getting started" {
+					t.Errorf("module name = %q", name)
+				}
+				if patched.Modules[0].Assignments[0].Id != original.Modules[0].Assignments[0].Id {
+					t.Error("assignment ID was not kept")
+				}
+				return
+			}
+			if len(changes) != len(tt.changed) {
+				t.Fatalf("changes = %v, want %v", changes, tt.changed)
+			}
+			for field, want := range tt.changed {
+				if changes[field] != want {
+					t.Errorf("%s = %v, want %v", field, changes[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoursePatchErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		status      int
+		code        string
+	}{
+		{"unsupported media type", "text/plain", `name=Go`, http.StatusUnsupportedMediaType, "unsupported_patch_type"},
+		{"failed test", jsonPatchType, `[{"op": "test", "path": "/name", "value": "Rust"}]`, http.StatusConflict, "patch_test_failed"},
+		{"missing path", jsonPatchType, `[{"op": "replace", "path": "/modules/5/name", "value": "x"}]`, http.StatusBadRequest, "invalid_patch"},
+		{"server field", mergePatchType, `{"creator_id": "5f1d7f9e8a0b4c2d3e4f5a6b"}`, http.StatusBadRequest, "invalid_patch"},
+		{"malformed", mergePatchType, `{"name":`, http.StatusBadRequest, "invalid_patch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := applyCoursePatch(tt.contentType, patchableCourse(), []byte(tt.patch))
+			var appErr *apperror.Error
+			if !errors.As(err, &appErr) {
+				t.Fatalf("err = %v, want an *apperror.Error", err)
+			}
+			if appErr.Status() != tt.status || appErr.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", appErr.Status(), appErr.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestPatchedCourseIsValidated(t *testing.T) {
+	patched, err := applyCoursePatch(mergePatchType, patchableCourse(), []byte(`{"name": null, "image": "not a url"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validate(&patched)
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) || appErr.Code != "invalid_fields" {
+		t.Fatalf("err = %v, want invalid_fields", err)
+	}
+	fields := appErr.Extensions["errors"].([]fieldError)
+	if len(fields) != 2 || fields[0].Field != "name" || fields[1].Field != "image" {
+		t.Errorf("errors = %+v", fields)
+	}
+}
+
+func TestForeignAssignmentIDsAreReplaced(t *testing.T) {
+	stored := models.Course{Modules: []models.Module{{Assignments: []models.Assignment{{Id: primitive.NewObjectID()}}}}}
+	kept := stored.Modules[0].Assignments[0].Id
+	foreign := primitive.NewObjectID()
+
+	modules := []models.Module{{Assignments: []models.Assignment{{Id: kept}, {Id: foreign}, {}}}}
+	assignAssignmentIDs(modules, &stored)
+	assignments := modules[0].Assignments
+	if assignments[0].Id != kept {
+		t.Error("the ID of a stored assignment was replaced")
+	}
+	if assignments[1].Id == foreign || assignments[1].Id.IsZero() {
+		t.Error("an ID from another course was kept")
+	}
+	if assignments[2].Id.IsZero() {
+		t.Error("a new assignment got no ID")
+	}
+
+	modules = []models.Module{{Assignments: []models.Assignment{{Id: kept}}}}
+	assignAssignmentIDs(modules, nil)
+	if modules[0].Assignments[0].Id == kept {
+		t.Error("a new course kept a client supplied assignment ID")
+	}
+}
+
+func TestLessonContentIsHiddenFromCourseResponses(t *testing.T) {
+	creator := primitive.NewObjectID()
+	lesson := models.Lesson{Name: "Hello", Link: "https://example.com/hello", Content: "Hello, world"}
+	courses := []models.Course{
+		{CreatorID: creator, Modules: []models.Module{{Lessons: []models.Lesson{lesson}}}},
+		{CreatorID: creator, Modules: []models.Module{{Lessons: []models.Lesson{lesson}}}},
+	}
+	stored := courses[0].Modules[0].Lessons
+
+	hideLessonContent(courses[:1], primitive.NewObjectID())
+	if got := courses[0].Modules[0].Lessons[0]; got != (models.Lesson{Name: "Hello"}) {
+		t.Errorf("lesson = %+v, want only its name", got)
+	}
+	if stored[0] != lesson {
+		t.Error("the stored course was modified")
+	}
+
+	hideLessonContent(courses[1:], creator)
+	if got := courses[1].Modules[0].Lessons[0]; got != lesson {
+		t.Errorf("the creator got %+v, want the full lesson", got)
+	}
+}
@@ -0,0 +1,612 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type page[T any] struct {
+	Items []T   `json:"items"`
+	Page  int64 `json:"page"`
+	Limit int64 `json:"limit"`
+	Total int64 `json:"total"`
+}
+
+type threadResponse struct {
+	Id             primitive.ObjectID  `json:"_id"`
+	Date           primitive.DateTime  `json:"date"`
+	CourseID       primitive.ObjectID  `json:"course_id"`
+	Lesson         *models.LessonRef   `json:"lesson,omitempty"`
+	AuthorID       primitive.ObjectID  `json:"author_id"`
+	Title          string              `json:"title"`
+	Body           string              `json:"body"`
+	Pinned         bool                `json:"pinned"`
+	Locked         bool                `json:"locked"`
+	AcceptedPostID *primitive.ObjectID `json:"accepted_post_id"`
+	ReplyCount     int                 `json:"reply_count"`
+	LastActivity   primitive.DateTime  `json:"last_activity"`
+	UpdatedAt      *primitive.DateTime `json:"updated_at,omitempty"`
+}
+
+func threadResponseOf(thread models.Thread) threadResponse {
+	return threadResponse{
+		Id:             thread.Id,
+		Date:           thread.Date,
+		CourseID:       thread.CourseID,
+		Lesson:         thread.Lesson,
+		AuthorID:       thread.AuthorID,
+		Title:          thread.Title,
+		Body:           thread.Body,
+		Pinned:         thread.Pinned,
+		Locked:         thread.Locked,
+		AcceptedPostID: thread.AcceptedPostID,
+		ReplyCount:     thread.ReplyCount,
+		LastActivity:   thread.LastActivity,
+		UpdatedAt:      thread.UpdatedAt,
+	}
+}
+
+type postResponse struct {
+	Id        primitive.ObjectID  `json:"_id"`
+	Date      primitive.DateTime  `json:"date"`
+	ThreadID  primitive.ObjectID  `json:"thread_id"`
+	ParentID  *primitive.ObjectID `json:"parent_id,omitempty"`
+	AuthorID  primitive.ObjectID  `json:"author_id"`
+	Body      string              `json:"body"`
+	Deleted   bool                `json:"deleted"`
+	UpdatedAt *primitive.DateTime `json:"updated_at,omitempty"`
+}
+
+func postResponseOf(post models.Post) postResponse {
+	return postResponse{
+		Id:        post.Id,
+		Date:      post.Date,
+		ThreadID:  post.ThreadID,
+		ParentID:  post.ParentID,
+		AuthorID:  post.AuthorID,
+		Body:      post.Body,
+		Deleted:   post.Deleted,
+		UpdatedAt: post.UpdatedAt,
+	}
+}
+
+type threadWithPosts struct {
+	Thread threadResponse     `json:"thread"`
+	Posts  page[postResponse] `json:"posts"`
+}
+
+func GetCourseThreads(c *gin.Context) {
+	_, course, ok := discussionCourseFromParam(c)
+	if !ok {
+		return
+	}
+
+	pageNumber, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"course_id": course.Id}
+	if c.Query("module") != "" || c.Query("lesson") != "" {
+		moduleIndex, err1 := strconv.Atoi(c.Query("module"))
+		lessonIndex, err2 := strconv.Atoi(c.Query("lesson"))
+		if err1 != nil || err2 != nil {
+			apperror.Respond(c, apperror.Validation("invalid_lesson_query", "Query parameters 'module' and 'lesson' must be given together as numbers"))
+			return
+		}
+		filter["lesson"] = models.LessonRef{Module: moduleIndex, Lesson: lessonIndex}
+	}
+
+	// Pinned threads stay on top; the rest are ordered by latest activity.
+	sort := bson.D{{Key: "pinned", Value: -1}, {Key: "last_activity", Value: -1}}
+	threads := []models.Thread{}
+	total, err := findPage(db.ThreadCollection, filter, sort, pageNumber, limit, &threads)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page[threadResponse]{Items: responsesOf(threads, threadResponseOf), Page: pageNumber, Limit: limit, Total: total})
+}
+
+type postThreadInput struct {
+	Title  string            `json:"title" binding:"required,max=200"`
+	Body   string            `json:"body" binding:"required,max=20000"`
+	Lesson *models.LessonRef `json:"lesson"`
+}
+
+func PostThread(c *gin.Context) {
+	userID, course, ok := discussionCourseFromParam(c)
+	if !ok {
+		return
+	}
+
+	var input postThreadInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if input.Lesson != nil {
+		if input.Lesson.Module < 0 || input.Lesson.Module >= len(course.Modules) ||
+			input.Lesson.Lesson < 0 || input.Lesson.Lesson >= len(course.Modules[input.Lesson.Module].Lessons) {
+			apperror.Respond(c, apperror.Validation("lesson_not_found", "Lesson not found"))
+			return
+		}
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	thread := models.Thread{
+		Id:           primitive.NewObjectID(),
+		Date:         now,
+		CourseID:     course.Id,
+		Lesson:       input.Lesson,
+		AuthorID:     userID,
+		Title:        input.Title,
+		Body:         input.Body,
+		LastActivity: now,
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.ThreadCollection, thread)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, threadResponseOf(thread))
+}
+
+func GetThread(c *gin.Context) {
+	_, thread, _, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	pageNumber, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	posts := []models.Post{}
+	sort := bson.D{{Key: "date", Value: 1}}
+	total, err := findPage(db.PostCollection, bson.M{"thread_id": thread.Id}, sort, pageNumber, limit, &posts)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, threadWithPosts{
+		Thread: threadResponseOf(*thread),
+		Posts:  page[postResponse]{Items: responsesOf(posts, postResponseOf), Page: pageNumber, Limit: limit, Total: total},
+	})
+}
+
+type updateThreadInput struct {
+	Title string `json:"title" binding:"required,max=200"`
+	Body  string `json:"body" binding:"required,max=20000"`
+}
+
+func UpdateThread(c *gin.Context) {
+	userID, thread, course, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	if thread.AuthorID != userID {
+		apperror.Respond(c, apperror.Forbidden("not_thread_author", "Only the author can edit this thread"))
+		return
+	}
+	if thread.Locked && course.CreatorID != userID {
+		apperror.Respond(c, apperror.Forbidden("thread_locked", "Thread is locked"))
+		return
+	}
+
+	var input updateThreadInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	err := updateThread(thread.Id, bson.M{"$set": bson.M{"title": input.Title, "body": input.Body, "updated_at": now}})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Thread updated successfully"})
+}
+
+func DeleteThread(c *gin.Context) {
+	userID, thread, course, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	if thread.AuthorID != userID && course.CreatorID != userID {
+		apperror.Respond(c, apperror.Forbidden("not_thread_author", "Only the author or the instructor can delete this thread"))
+		return
+	}
+
+	if err := deleteThread(thread.Id); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Thread deleted successfully"})
+}
+
+func deleteThread(threadID primitive.ObjectID) error {
+	database := db.Instance.Client.Database(db.Instance.Dbname)
+	if _, err := database.Collection(db.PostCollection).DeleteMany(context.Background(), bson.M{"thread_id": threadID}); err != nil {
+		return err
+	}
+	_, err := database.Collection(db.ThreadCollection).DeleteOne(context.Background(), bson.M{"_id": threadID})
+	return err
+}
+
+type replyToThreadInput struct {
+	Body     string              `json:"body" binding:"required,max=20000"`
+	ParentID *primitive.ObjectID `json:"parent_id"`
+}
+
+func ReplyToThread(c *gin.Context) {
+	userID, thread, course, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	if thread.Locked && course.CreatorID != userID {
+		apperror.Respond(c, apperror.Forbidden("thread_locked", "Thread is locked"))
+		return
+	}
+
+	var input replyToThreadInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if input.ParentID != nil {
+		parent, err := getPostByID(*input.ParentID)
+		if err != nil && err != mongo.ErrNoDocuments {
+			apperror.Respond(c, err)
+			return
+		}
+		if parent == nil || parent.ThreadID != thread.Id || parent.Deleted {
+			apperror.Respond(c, apperror.Validation("parent_post_not_in_thread", "Parent post not found in this thread"))
+			return
+		}
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	post := models.Post{
+		Id:       primitive.NewObjectID(),
+		Date:     now,
+		ThreadID: thread.Id,
+		ParentID: input.ParentID,
+		AuthorID: userID,
+		Body:     input.Body,
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.PostCollection, post)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	err = updateThread(thread.Id, bson.M{"$inc": bson.M{"reply_count": 1}, "$set": bson.M{"last_activity": now}})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, postResponseOf(post))
+}
+
+type updatePostInput struct {
+	Body string `json:"body" binding:"required,max=20000"`
+}
+
+func UpdatePost(c *gin.Context) {
+	post, ok := ownPostFromParam(c)
+	if !ok {
+		return
+	}
+
+	var input updatePostInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	err := updatePost(post.Id, bson.M{"body": input.Body, "updated_at": now})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Post updated successfully"})
+}
+
+// DeletePost only blanks the post so replies to it keep their place in the
+// thread.
+func DeletePost(c *gin.Context) {
+	post, ok := ownPostFromParam(c)
+	if !ok {
+		return
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	err := updatePost(post.Id, bson.M{"body": "", "deleted": true, "updated_at": now})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Post deleted successfully"})
+}
+
+func PinThread(c *gin.Context) {
+	setThreadFlag(c, "pinned")
+}
+
+func LockThread(c *gin.Context) {
+	setThreadFlag(c, "locked")
+}
+
+type setThreadFlagInput struct {
+	Value *bool `json:"value" binding:"required"`
+}
+
+// setThreadFlag lets the course instructor set a boolean moderation flag on
+// a thread from a {"value": bool} body.
+func setThreadFlag(c *gin.Context, field string) {
+	userID, thread, course, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	if course.CreatorID != userID {
+		apperror.Respond(c, apperror.Forbidden("not_course_creator", "User is not the creator of the course"))
+		return
+	}
+
+	var input setThreadFlagInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if err := updateThread(thread.Id, bson.M{"$set": bson.M{field: *input.Value}}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Thread updated successfully"})
+}
+
+type acceptAnswerInput struct {
+	PostID *primitive.ObjectID `json:"post_id"`
+}
+
+// AcceptAnswer marks a reply as the accepted answer. The thread author or the
+// instructor may do it; sending a null post_id clears the accepted answer.
+func AcceptAnswer(c *gin.Context) {
+	userID, thread, course, ok := threadFromParam(c)
+	if !ok {
+		return
+	}
+
+	if thread.AuthorID != userID && course.CreatorID != userID {
+		apperror.Respond(c, apperror.Forbidden("not_thread_author", "Only the author or the instructor can accept an answer"))
+		return
+	}
+
+	var input acceptAnswerInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if input.PostID != nil {
+		post, err := getPostByID(*input.PostID)
+		if err != nil && err != mongo.ErrNoDocuments {
+			apperror.Respond(c, err)
+			return
+		}
+		if post == nil || post.ThreadID != thread.Id || post.Deleted {
+			apperror.Respond(c, apperror.Validation("post_not_in_thread", "Post not found in this thread"))
+			return
+		}
+	}
+
+	if err := updateThread(thread.Id, bson.M{"$set": bson.M{"accepted_post_id": input.PostID}}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Accepted answer updated successfully"})
+}
+
+func updateThread(id primitive.ObjectID, update bson.M) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.ThreadCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, update)
+	return err
+}
+
+func updatePost(id primitive.ObjectID, updateData bson.M) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.PostCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": updateData})
+	return err
+}
+
+func getPostByID(id primitive.ObjectID) (*models.Post, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.PostCollection)
+	var post models.Post
+	if err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&post); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// canParticipate reports whether the user may read and write in a course's
+// discussions: its instructor and enrolled learners may.
+func canParticipate(userID primitive.ObjectID, course *models.Course) (bool, error) {
+	if course.CreatorID == userID {
+		return true, nil
+	}
+	return isEnrolled(userID, course.Id)
+}
+
+func requireParticipant(c *gin.Context, userID primitive.ObjectID, course *models.Course) bool {
+	allowed, err := canParticipate(userID, course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return false
+	}
+	if !allowed {
+		apperror.Respond(c, apperror.Forbidden("not_enrolled", "User is not enrolled in this course"))
+		return false
+	}
+	return true
+}
+
+func discussionCourseFromParam(c *gin.Context) (primitive.ObjectID, *models.Course, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return primitive.NilObjectID, nil, false
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return primitive.NilObjectID, nil, false
+	}
+
+	if !requireParticipant(c, userID.(primitive.ObjectID), course) {
+		return primitive.NilObjectID, nil, false
+	}
+
+	return userID.(primitive.ObjectID), course, true
+}
+
+// threadFromParam loads the thread named by ":id" together with its course,
+// after checking that the user may take part in the course's discussions.
+func threadFromParam(c *gin.Context) (primitive.ObjectID, *models.Thread, *models.Course, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return primitive.NilObjectID, nil, nil, false
+	}
+
+	threadID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_thread_id", "Invalid thread ID"))
+		return primitive.NilObjectID, nil, nil, false
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.ThreadCollection)
+	var thread models.Thread
+	err = collection.FindOne(context.Background(), bson.M{"_id": threadID}).Decode(&thread)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("thread_not_found", "Thread not found"))
+			return primitive.NilObjectID, nil, nil, false
+		}
+		apperror.Respond(c, err)
+		return primitive.NilObjectID, nil, nil, false
+	}
+
+	course, err := getCourseByID(thread.CourseID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return primitive.NilObjectID, nil, nil, false
+	}
+
+	if !requireParticipant(c, userID.(primitive.ObjectID), course) {
+		return primitive.NilObjectID, nil, nil, false
+	}
+
+	return userID.(primitive.ObjectID), &thread, course, true
+}
+
+// ownPostFromParam loads the post named by ":id", which must belong to the
+// authenticated user and must not be deleted.
+func ownPostFromParam(c *gin.Context) (*models.Post, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return nil, false
+	}
+
+	postID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_post_id", "Invalid post ID"))
+		return nil, false
+	}
+
+	post, err := getPostByID(postID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("post_not_found", "Post not found"))
+			return nil, false
+		}
+		apperror.Respond(c, err)
+		return nil, false
+	}
+
+	if post.AuthorID != userID.(primitive.ObjectID) || post.Deleted {
+		apperror.Respond(c, apperror.Forbidden("not_post_author", "Only the author can change this post"))
+		return nil, false
+	}
+
+	return post, true
+}
+
+// pageParams reads the 1-based "page" and "limit" query parameters.
+func pageParams(c *gin.Context) (int64, int64, bool) {
+	pageNumber, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || pageNumber < 1 {
+		apperror.Respond(c, apperror.Validation("invalid_page", "Query parameter 'page' must be a positive number"))
+		return 0, 0, false
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)), 10, 64)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		apperror.Respond(c, apperror.Validation("invalid_limit", "Query parameter 'limit' must be between 1 and 100"))
+		return 0, 0, false
+	}
+
+	return pageNumber, limit, true
+}
+
+// findPage decodes one page of documents matching filter into results and
+// returns the total number of matching documents.
+func findPage(col string, filter bson.M, sort bson.D, pageNumber, limit int64, results interface{}) (int64, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(col)
+	total, err := collection.CountDocuments(context.Background(), filter)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := options.Find().SetSort(sort).SetSkip((pageNumber - 1) * limit).SetLimit(limit)
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	return total, cursor.All(context.Background(), results)
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Endpoint documents a handler for the OpenAPI specification. Request and
+// Response are zero values of the body types; a nil Request means the
+// handler reads no body.
+type Endpoint struct {
+	Tag         string
+	Summary     string
+	Description string
+	Query       []QueryParam
+	Request     interface{}
+	// Requests are the bodies of a handler that reads several media types,
+	// by media type, in place of Request.
+	Requests map[string]interface{}
+	Response interface{}
+	// ContentType is the type of the response body when it is not JSON.
+	ContentType string
+	// Status is the status of a successful response, http.StatusOK when 0.
+	Status int
+}
+
+type QueryParam struct {
+	Name        string
+	Description string
+}
+
+// jsonPatchOperation is one operation of a JSON Patch (RFC 6902).
+type jsonPatchOperation struct {
+	Op    string      `json:"op" binding:"required,oneof=add remove replace move copy test"`
+	Path  string      `json:"path" binding:"required"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// message is the body of responses that only confirm an action.
+type message struct {
+	Message string `json:"message"`
+}
+
+const (
+	tagAuth         = "Authentication"
+	tagAccount      = "Account"
+	tagCourses      = "Courses"
+	tagLearning     = "Learning"
+	tagCohorts      = "Cohorts"
+	tagPaths        = "Learning paths"
+	tagDiscussions  = "Discussions"
+	tagNotes        = "Notes and bookmarks"
+	tagCertificates = "Certificates"
+	tagProfiles     = "Profiles"
+)
+
+var (
+	pageQuery = []QueryParam{
+		{"page", "Page number, starting at 1"},
+		{"limit", "Items per page"},
+	}
+	formatParam  = QueryParam{"format", "markdown (the default) or html"}
+	courseFilter = QueryParam{"course", "Only include items of this course"}
+)
+
+var endpoints = []struct {
+	handler gin.HandlerFunc
+	Endpoint
+}{
+	{Register, Endpoint{Tag: tagAuth, Summary: "Create an account", Request: registerInput{}, Response: userResponse{}}},
+	{Login, Endpoint{Tag: tagAuth, Summary: "Log in with email and password",
+		Description: "Accounts with two-factor authentication get a challenge token to exchange at /auth/login/2fa instead of a session token.",
+		Request:     loginInput{}, Response: loginResult{}}},
+	{LoginTwoFactor, Endpoint{Tag: tagAuth, Summary: "Complete a login with a TOTP or recovery code", Request: loginTwoFactorInput{}, Response: loginResult{}}},
+	{GetIdentityProviders, Endpoint{Tag: tagAuth, Summary: "List the OpenID Connect providers", Response: identityProviderList{}}},
+	{StartExternalLogin, Endpoint{Tag: tagAuth, Summary: "Redirect to the login page of a provider", Status: http.StatusFound,
+		Description: "Sets the oidc_state cookie the callback checks, so the login must finish in the same browser."}},
+	{ExternalLoginCallback, Endpoint{Tag: tagAuth, Summary: "Complete a login at a provider", Status: http.StatusFound,
+		Description: "Redirects to OIDC_LOGIN_REDIRECT_URL with a one-time code query parameter to exchange at /auth/oidc/exchange.",
+		Query:       []QueryParam{{"code", "Authorization code"}, {"state", "State sent to the provider"}, {"error", "Error reported by the provider"}}}},
+	{ExchangeExternalLogin, Endpoint{Tag: tagAuth, Summary: "Exchange the one-time code of an external login",
+		Description: "Accounts with two-factor authentication get a challenge token to exchange at /auth/login/2fa instead of a session token.",
+		Request:     exchangeExternalLoginInput{}, Response: loginResult{}}},
+
+	{GetProfile, Endpoint{Tag: tagProfiles, Summary: "Get your profile", Response: profile{}}},
+	{UpdateProfile, Endpoint{Tag: tagProfiles, Summary: "Update your profile", Request: profileInput{}, Response: profile{}}},
+	{GetInstructorProfile, Endpoint{Tag: tagProfiles, Summary: "Get the public profile of an instructor", Response: instructorProfile{}}},
+
+	{ConfirmEmailChange, Endpoint{Tag: tagAccount, Summary: "Confirm a new email address", Request: confirmEmailChangeInput{}, Response: message{}}},
+	{ForgotPassword, Endpoint{Tag: tagAccount, Summary: "Email a password reset code", Request: forgotPasswordInput{}, Response: message{}}},
+	{ResetPassword, Endpoint{Tag: tagAccount, Summary: "Set a new password with a reset code", Request: resetPasswordInput{}, Response: message{}}},
+	{ChangePassword, Endpoint{Tag: tagAccount, Summary: "Change your password", Request: changePasswordInput{}, Response: message{}}},
+	{RequestEmailChange, Endpoint{Tag: tagAccount, Summary: "Start changing your email address", Request: requestEmailChangeInput{}, Response: message{}}},
+	{GetSecurityEvents, Endpoint{Tag: tagAccount, Summary: "List security events of your account", Response: []securityEventResponse{}}},
+	{SetupTwoFactor, Endpoint{Tag: tagAccount, Summary: "Create a pending TOTP secret", Request: setupTwoFactorInput{}, Response: twoFactorSetup{}}},
+	{ConfirmTwoFactor, Endpoint{Tag: tagAccount, Summary: "Enable two-factor authentication", Request: confirmTwoFactorInput{}, Response: recoveryCodes{}}},
+	{DisableTwoFactor, Endpoint{Tag: tagAccount, Summary: "Disable two-factor authentication", Request: disableTwoFactorInput{}, Response: message{}}},
+	{RegenerateRecoveryCodes, Endpoint{Tag: tagAccount, Summary: "Replace your recovery codes", Request: regenerateRecoveryCodesInput{}, Response: recoveryCodes{}}},
+	{PostAPIKey, Endpoint{Tag: tagAccount, Summary: "Create an API key",
+		Description: "The key is only included in this response.",
+		Request:     postAPIKeyInput{}, Response: createdAPIKey{}}},
+	{GetAPIKeys, Endpoint{Tag: tagAccount, Summary: "List your API keys", Response: []apiKeyResponse{}}},
+	{RevokeAPIKey, Endpoint{Tag: tagAccount, Summary: "Revoke an API key", Response: message{}}},
+	{GetSessions, Endpoint{Tag: tagAccount, Summary: "List your sessions", Response: []sessionResponse{}}},
+	{RevokeSession, Endpoint{Tag: tagAccount, Summary: "Log out of a session", Response: message{}}},
+	{RevokeOtherSessions, Endpoint{Tag: tagAccount, Summary: "Log out of every other session", Response: message{}}},
+	{ExportUserData, Endpoint{Tag: tagAccount, Summary: "Download all your data as a zip archive", ContentType: "application/zip"}},
+	{RequestAccountDeletion, Endpoint{Tag: tagAccount, Summary: "Schedule your account for deletion", Request: requestAccountDeletionInput{}, Response: scheduledDeletion{}}},
+	{CancelAccountDeletion, Endpoint{Tag: tagAccount, Summary: "Cancel the deletion of your account", Response: message{}}},
+
+	{GetAllCourses, Endpoint{Tag: tagCourses, Summary: "List courses", Response: []courseResponse{}}},
+	{SearchCourses, Endpoint{Tag: tagCourses, Summary: "Search courses", Query: []QueryParam{{"q", "Search terms"}}, Response: []courseResponse{}}},
+	{PostCourse, Endpoint{Tag: tagCourses, Summary: "Create a course", Request: courseInput{}, Response: courseResponse{}}},
+	{GetCourseByID, Endpoint{Tag: tagCourses, Summary: "Get a course", Response: courseResponse{}}},
+	{UpdateCourseValue, Endpoint{Tag: tagCourses, Summary: "Replace a course", Request: courseInput{}, Response: message{}}},
+	{PatchCourse, Endpoint{Tag: tagCourses, Summary: "Change some fields of a course",
+		Description: "Takes a JSON Merge Patch, where fields left out keep their value, or a JSON Patch. " +
+			"Both apply to the fields of CourseInput; the result must be a valid CourseInput.",
+		Requests: map[string]interface{}{
+			mergePatchType: courseInput{},
+			jsonPatchType:  []jsonPatchOperation{},
+		},
+		Response: courseResponse{}}},
+	{DeleteCourse, Endpoint{Tag: tagCourses, Summary: "Delete a course", Response: message{}}},
+	{GetCourseDescription, Endpoint{Tag: tagCourses, Summary: "Get the rendered description of a course", Query: []QueryParam{formatParam}, Response: renderedContent{}}},
+	{RateCourse, Endpoint{Tag: tagCourses, Summary: "Rate a course", Request: ratingInput{}, Response: message{}}},
+	{AddCourseToUser, Endpoint{Tag: tagCourses, Summary: "Enroll a user in a course", Request: addCourseToUserInput{}, Response: message{}}},
+	{GetUserCourses, Endpoint{Tag: tagCourses, Summary: "List the courses a user is enrolled in", Response: []courseResponse{}}},
+
+	{GetLessonContent, Endpoint{Tag: tagLearning, Summary: "Get the rendered content of a lesson", Query: []QueryParam{formatParam}, Response: renderedContent{}}},
+	{GetCourseProgress, Endpoint{Tag: tagLearning, Summary: "Get your progress in a course", Response: courseStatus{}}},
+	{CompleteLesson, Endpoint{Tag: tagLearning, Summary: "Mark a lesson as completed", Response: courseStatus{}}},
+	{GetQuiz, Endpoint{Tag: tagLearning, Summary: "Get the quiz of a module", Response: quizOverview{}}},
+	{SubmitQuizAttempt, Endpoint{Tag: tagLearning, Summary: "Submit answers to a quiz", Request: submitQuizAttemptInput{}, Response: quizResult{}}},
+	{GetQuizAttempts, Endpoint{Tag: tagLearning, Summary: "List your attempts at a quiz", Response: []quizAttemptResponse{}}},
+	{SubmitAssignment, Endpoint{Tag: tagLearning, Summary: "Submit an assignment", Request: submitAssignmentInput{}, Response: submissionResponse{}}},
+	{GetAssignmentSubmissions, Endpoint{Tag: tagLearning, Summary: "List submissions of an assignment",
+		Description: "Instructors see every submission, learners only their own.",
+		Response:    []submissionResponse{}}},
+	{GradeSubmission, Endpoint{Tag: tagLearning, Summary: "Grade a submission", Request: gradeSubmissionInput{}, Response: submissionResponse{}}},
+	{GetGradebook, Endpoint{Tag: tagLearning, Summary: "Get the gradebook of a course", Response: []gradebookRow{}}},
+
+	{GetUserCertificates, Endpoint{Tag: tagCertificates, Summary: "List your certificates", Response: []certificateResponse{}}},
+	{DownloadCertificate, Endpoint{Tag: tagCertificates, Summary: "Download a certificate", ContentType: "application/pdf"}},
+	{VerifyCertificate, Endpoint{Tag: tagCertificates, Summary: "Verify a certificate by its code", Response: certificateVerification{}}},
+
+	{PostCohort, Endpoint{Tag: tagCohorts, Summary: "Schedule a cohort of a course", Request: cohortInput{}, Response: cohortSummary{}}},
+	{GetCourseCohorts, Endpoint{Tag: tagCohorts, Summary: "List the cohorts of a course", Response: []cohortSummary{}}},
+	{EnrollInCohort, Endpoint{Tag: tagCohorts, Summary: "Enroll in a cohort or join its waitlist", Response: cohortEnrollment{}}},
+	{LeaveCohort, Endpoint{Tag: tagCohorts, Summary: "Leave a cohort", Response: message{}}},
+	{GetCohortRoster, Endpoint{Tag: tagCohorts, Summary: "Get the members and waitlist of a cohort", Response: cohortRoster{}}},
+
+	{GetLearningPaths, Endpoint{Tag: tagPaths, Summary: "List published learning paths", Response: []pathResponse{}}},
+	{PostLearningPath, Endpoint{Tag: tagPaths, Summary: "Create a learning path", Request: pathInput{}, Response: pathResponse{}}},
+	{GetLearningPathByID, Endpoint{Tag: tagPaths, Summary: "Get a learning path", Response: pathResponse{}}},
+	{UpdateLearningPath, Endpoint{Tag: tagPaths, Summary: "Replace a learning path", Request: pathInput{}, Response: message{}}},
+	{PublishLearningPath, Endpoint{Tag: tagPaths, Summary: "Publish a learning path", Response: message{}}},
+	{DeleteLearningPath, Endpoint{Tag: tagPaths, Summary: "Delete a learning path", Response: message{}}},
+	{EnrollInLearningPath, Endpoint{Tag: tagPaths, Summary: "Enroll in a learning path", Response: message{}}},
+	{GetLearningPathProgress, Endpoint{Tag: tagPaths, Summary: "Get your progress in a learning path", Response: pathProgress{}}},
+
+	{GetCourseThreads, Endpoint{Tag: tagDiscussions, Summary: "List the threads of a course",
+		Query:    append([]QueryParam{{"module", "Only threads about this module; requires lesson"}, {"lesson", "Only threads about this lesson"}}, pageQuery...),
+		Response: page[threadResponse]{}}},
+	{PostThread, Endpoint{Tag: tagDiscussions, Summary: "Start a thread", Request: postThreadInput{}, Response: threadResponse{}}},
+	{GetThread, Endpoint{Tag: tagDiscussions, Summary: "Get a thread and a page of its posts", Query: pageQuery, Response: threadWithPosts{}}},
+	{UpdateThread, Endpoint{Tag: tagDiscussions, Summary: "Edit a thread", Request: updateThreadInput{}, Response: message{}}},
+	{DeleteThread, Endpoint{Tag: tagDiscussions, Summary: "Delete a thread", Response: message{}}},
+	{ReplyToThread, Endpoint{Tag: tagDiscussions, Summary: "Reply to a thread", Request: replyToThreadInput{}, Response: postResponse{}}},
+	{PinThread, Endpoint{Tag: tagDiscussions, Summary: "Pin or unpin a thread", Request: setThreadFlagInput{}, Response: message{}}},
+	{LockThread, Endpoint{Tag: tagDiscussions, Summary: "Lock or unlock a thread", Request: setThreadFlagInput{}, Response: message{}}},
+	{AcceptAnswer, Endpoint{Tag: tagDiscussions, Summary: "Set or clear the accepted answer", Request: acceptAnswerInput{}, Response: message{}}},
+	{UpdatePost, Endpoint{Tag: tagDiscussions, Summary: "Edit a post", Request: updatePostInput{}, Response: message{}}},
+	{DeletePost, Endpoint{Tag: tagDiscussions, Summary: "Delete a post", Response: message{}}},
+
+	{PostNote, Endpoint{Tag: tagNotes, Summary: "Take a note on a lesson", Request: noteInput{}, Response: noteResponse{}}},
+	{UpdateNote, Endpoint{Tag: tagNotes, Summary: "Edit a note", Request: noteInput{}, Response: message{}}},
+	{DeleteNote, Endpoint{Tag: tagNotes, Summary: "Delete a note", Response: message{}}},
+	{GetUserNotes, Endpoint{Tag: tagNotes, Summary: "List your notes", Query: []QueryParam{courseFilter}, Response: []noteResponse{}}},
+	{ExportNotes, Endpoint{Tag: tagNotes, Summary: "Export your notes and bookmarks as Markdown", Query: []QueryParam{courseFilter}, ContentType: "text/markdown"}},
+	{PostBookmark, Endpoint{Tag: tagNotes, Summary: "Bookmark a lesson", Response: bookmarkResponse{}}},
+	{DeleteBookmark, Endpoint{Tag: tagNotes, Summary: "Remove a bookmark", Response: message{}}},
+	{GetUserBookmarks, Endpoint{Tag: tagNotes, Summary: "List your bookmarks", Query: []QueryParam{courseFilter}, Response: []bookmarkResponse{}}},
+}
+
+// Describe returns the documentation of handler, which must be one of the
+// exported handlers of this package.
+func Describe(handler gin.HandlerFunc) (Endpoint, bool) {
+	pc := reflect.ValueOf(handler).Pointer()
+	for _, e := range endpoints {
+		if reflect.ValueOf(e.handler).Pointer() == pc {
+			return e.Endpoint, true
+		}
+	}
+	return Endpoint{}, false
+}
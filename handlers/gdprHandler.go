@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultDeletionGraceDays = 30
+
+// accountPurgeLease is how long a purger instance holds an account it is
+// purging before another may retry it.
+const accountPurgeLease = 10 * time.Minute
+
+const (
+	eventAccountDeletionRequested = "account_deletion_requested"
+	eventAccountDeletionCanceled  = "account_deletion_canceled"
+)
+
+// exportFile is one JSON document inside the export archive, read from
+// collection with filter.
+type exportFile struct {
+	name       string
+	collection string
+	filter     bson.M
+}
+
+// exportOmittedFields are stored secrets left out of the export, since the
+// archive is a plain file that may be passed around.
+var exportOmittedFields = map[string]bson.M{
+	db.APIKeyCollection: {"hash": 0},
+}
+
+type exportedRating struct {
+	CourseID   primitive.ObjectID `json:"course_id"`
+	CourseName string             `json:"course_name"`
+	Score      int                `json:"score"`
+	Review     string             `json:"review"`
+}
+
+type exportedCohort struct {
+	CohortID primitive.ObjectID `json:"cohort_id"`
+	Name     string             `json:"name"`
+	Status   string             `json:"status"`
+}
+
+// ExportUserData returns a zip archive with one JSON file per kind of data
+// the platform stores about the user.
+func ExportUserData(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	archive, err := exportUserData(user)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	filename := fmt.Sprintf("freelearn-export-%s.zip", time.Now().Format("2006-01-02"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+func exportUserData(user *models.User) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	account := gin.H{
+		"profile":     profileOf(user),
+		"registered":  user.Date,
+		"enrollments": user.Cursos,
+		"paths":       user.Paths,
+	}
+	if err := writeExportFile(archive, "account.json", account); err != nil {
+		return nil, err
+	}
+
+	ratings, err := userRatings(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeExportFile(archive, "ratings.json", ratings); err != nil {
+		return nil, err
+	}
+
+	cohorts, err := userCohorts(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeExportFile(archive, "cohorts.json", cohorts); err != nil {
+		return nil, err
+	}
+
+	files := []exportFile{
+		{"progress.json", db.ProgressCollection, bson.M{"user_id": user.Id}},
+		{"quiz_attempts.json", db.QuizAttemptCollection, bson.M{"user_id": user.Id}},
+		{"submissions.json", db.SubmissionCollection, bson.M{"user_id": user.Id}},
+		{"certificates.json", db.CertificateCollection, bson.M{"user_id": user.Id}},
+		{"notes.json", db.NoteCollection, bson.M{"user_id": user.Id}},
+		{"bookmarks.json", db.BookmarkCollection, bson.M{"user_id": user.Id}},
+		{"threads.json", db.ThreadCollection, bson.M{"author_id": user.Id}},
+		{"posts.json", db.PostCollection, bson.M{"author_id": user.Id}},
+		{"created_courses.json", db.CourseCollection, bson.M{"creator_id": user.Id}},
+		{"created_paths.json", db.LearningPathCollection, bson.M{"creator_id": user.Id}},
+		{"security_events.json", db.SecurityEventCollection, bson.M{"user_id": user.Id}},
+		{"api_keys.json", db.APIKeyCollection, bson.M{"user_id": user.Id}},
+		{"sessions.json", db.SessionCollection, bson.M{"user_id": user.Id}},
+	}
+	for _, file := range files {
+		documents, err := findDocuments(file.collection, file.filter, exportOmittedFields[file.collection])
+		if err != nil {
+			return nil, err
+		}
+		if err := writeExportFile(archive, file.name, documents); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeExportFile(archive *zip.Writer, name string, value interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// findDocuments decodes into plain documents so every collection can be
+// exported the same way, including fields added later.
+func findDocuments(collectionName string, filter, projection bson.M) ([]bson.M, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(collectionName)
+	opts := options.Find()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	documents := []bson.M{}
+	if err = cursor.All(context.Background(), &documents); err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+// userRatings pulls the user's own reviews out of the courses they rated.
+func userRatings(userID primitive.ObjectID) ([]exportedRating, error) {
+	courses, err := findCourses(bson.M{"ratings.user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+
+	ratings := []exportedRating{}
+	for _, course := range courses {
+		for _, rating := range course.Ratings {
+			if rating.UserID == userID {
+				ratings = append(ratings, exportedRating{
+					CourseID:   course.Id,
+					CourseName: course.Name,
+					Score:      rating.Score,
+					Review:     rating.Review,
+				})
+			}
+		}
+	}
+	return ratings, nil
+}
+
+// userCohorts lists the cohorts the user is in or waiting for, without the
+// other members.
+func userCohorts(userID primitive.ObjectID) ([]exportedCohort, error) {
+	found, err := findCohorts(bson.M{"$or": []bson.M{{"members": userID}, {"waitlist": userID}}})
+	if err != nil {
+		return nil, err
+	}
+
+	cohorts := []exportedCohort{}
+	for _, cohort := range found {
+		status := cohortWaitlisted
+		for _, member := range cohort.Members {
+			if member == userID {
+				status = cohortEnrolled
+				break
+			}
+		}
+		cohorts = append(cohorts, exportedCohort{CohortID: cohort.Id, Name: cohort.Name, Status: status})
+	}
+	return cohorts, nil
+}
+
+type scheduledDeletion struct {
+	Message      string    `json:"message"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
+
+type requestAccountDeletionInput struct {
+	Password   string `json:"password" binding:"required"`
+	Courses    string `json:"courses" binding:"omitempty,oneof=transfer archive"`
+	TransferTo string `json:"transfer_to"`
+}
+
+// RequestAccountDeletion schedules the account for deletion once the grace
+// period is over. Courses the user created are either handed over to
+// another professor or archived.
+func RequestAccountDeletion(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input requestAccountDeletionInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !checkCurrentPassword(c, user, input.Password, "Password is incorrect") {
+		return
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	switch input.Courses {
+	case "", models.DeletionArchiveCourses:
+		set["deletion_courses"] = models.DeletionArchiveCourses
+		unset["deletion_transfer_to"] = ""
+	case models.DeletionTransferCourses:
+		target, err := getUserByEmail(strings.TrimSpace(input.TransferTo))
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		if target == nil || !target.Professor || target.Id == user.Id {
+			apperror.Respond(c, apperror.Validation("invalid_transfer_target", "transfer_to must be the email of another professor"))
+			return
+		}
+		set["deletion_courses"] = models.DeletionTransferCourses
+		set["deletion_transfer_to"] = target.Id
+	default:
+		apperror.Respond(c, apperror.Validation("invalid_deletion_option", `courses must be "transfer" or "archive"`))
+		return
+	}
+
+	scheduledFor := time.Now().Add(deletionGracePeriod())
+	set["deletion_scheduled_for"] = primitive.NewDateTimeFromTime(scheduledFor)
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if err := updateUserByID(user.Id, update); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventAccountDeletionRequested)
+	c.JSON(http.StatusOK, scheduledDeletion{Message: "Account scheduled for deletion", ScheduledFor: scheduledFor})
+}
+
+func CancelAccountDeletion(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	if user.DeletionScheduledFor == 0 {
+		apperror.Respond(c, apperror.Validation("deletion_not_scheduled", "Account is not scheduled for deletion"))
+		return
+	}
+
+	err := updateUserByID(user.Id, bson.M{"$unset": bson.M{
+		"deletion_scheduled_for": "",
+		"deletion_courses":       "",
+		"deletion_transfer_to":   "",
+		"deletion_claimed_until": "",
+	}})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventAccountDeletionCanceled)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion canceled"})
+}
+
+// deletionGracePeriod reads ACCOUNT_DELETION_GRACE_DAYS, defaulting to 30
+// days.
+func deletionGracePeriod() time.Duration {
+	days := defaultDeletionGraceDays
+	if value := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartAccountPurger deletes accounts whose grace period is over, checking
+// every interval in the background.
+func StartAccountPurger(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := purgeDueAccounts(); err != nil {
+				log.Printf("gdpr: purging accounts: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeDueAccounts purges every account whose grace period is over. Each
+// account is claimed for accountPurgeLease first, so instances running the
+// purger at the same time never purge the same account; a claim that
+// expires, because its purge failed, is taken again on a later run.
+func purgeDueAccounts() error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	for {
+		now := time.Now()
+		filter := bson.M{
+			"deletion_scheduled_for": bson.M{"$gt": primitive.DateTime(0), "$lte": primitive.NewDateTimeFromTime(now)},
+			"$or": []bson.M{
+				{"deletion_claimed_until": bson.M{"$exists": false}},
+				{"deletion_claimed_until": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+			},
+		}
+		claim := bson.M{"$set": bson.M{"deletion_claimed_until": primitive.NewDateTimeFromTime(now.Add(accountPurgeLease))}}
+
+		var user models.User
+		err := collection.FindOneAndUpdate(context.Background(), filter, claim).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := purgeAccount(&user); err != nil {
+			log.Printf("gdpr: purging account %s: %v", user.Id.Hex(), err)
+		}
+	}
+}
+
+// purgeAccount erases the user's personal data. Reviews and discussion posts
+// stay but are no longer attributed to anyone; created courses and paths
+// are transferred or archived as the user chose. The user document goes
+// last so a failure midway is retried on the next run.
+func purgeAccount(user *models.User) error {
+	ctx := context.Background()
+	database := db.Instance.Client.Database(db.Instance.Dbname)
+
+	_, err := database.Collection(db.CourseCollection).UpdateMany(ctx,
+		bson.M{"ratings.user_id": user.Id},
+		bson.M{"$set": bson.M{"ratings.$[r].user_id": primitive.NilObjectID}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"r.user_id": user.Id}}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{
+		db.ProgressCollection,
+		db.QuizAttemptCollection,
+		db.SubmissionCollection,
+		db.CertificateCollection,
+		db.NoteCollection,
+		db.BookmarkCollection,
+		db.SecurityEventCollection,
+		db.APIKeyCollection,
+		db.SessionCollection,
+	} {
+		if _, err := database.Collection(name).DeleteMany(ctx, bson.M{"user_id": user.Id}); err != nil {
+			return err
+		}
+	}
+
+	_, err = database.Collection(db.CohortCollection).UpdateMany(ctx,
+		bson.M{"$or": []bson.M{{"members": user.Id}, {"waitlist": user.Id}}},
+		bson.M{"$pull": bson.M{"members": user.Id, "waitlist": user.Id}},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{db.ThreadCollection, db.PostCollection} {
+		_, err := database.Collection(name).UpdateMany(ctx,
+			bson.M{"author_id": user.Id},
+			bson.M{"$set": bson.M{"author_id": primitive.NilObjectID}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := handOverCreatedContent(user); err != nil {
+		return err
+	}
+
+	if err := clearLoginFailures(user.Email); err != nil {
+		return err
+	}
+
+	_, err = database.Collection(db.UserCollection).DeleteOne(ctx, bson.M{"_id": user.Id})
+	auth.InvalidateUser(user.Id)
+	return err
+}
+
+// handOverCreatedContent transfers the user's courses and paths to the
+// chosen professor. If there is none, or they have since lost access,
+// courses are archived and paths unpublished instead.
+func handOverCreatedContent(user *models.User) error {
+	ctx := context.Background()
+	database := db.Instance.Client.Database(db.Instance.Dbname)
+	filter := bson.M{"creator_id": user.Id}
+
+	if user.DeletionCourses == models.DeletionTransferCourses && user.DeletionTransferTo != nil {
+		target, err := getUserByID(*user.DeletionTransferTo)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err == nil && target.Professor {
+			update := bson.M{"$set": bson.M{"creator_id": target.Id}}
+			if _, err := database.Collection(db.CourseCollection).UpdateMany(ctx, filter, update); err != nil {
+				return err
+			}
+			_, err := database.Collection(db.LearningPathCollection).UpdateMany(ctx, filter, update)
+			return err
+		}
+	}
+
+	_, err := database.Collection(db.CourseCollection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"archived": true}})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection(db.LearningPathCollection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"published": false}})
+	return err
+}
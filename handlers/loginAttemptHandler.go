@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failures are forgotten after loginAttemptWindow without a new one. Past
+// the threshold of a key, every further failure locks it for twice as long
+// as the previous one, starting at loginLockoutBase and capped at
+// loginLockoutMax.
+const (
+	accountFailureThreshold = 5
+	ipFailureThreshold      = 20
+	loginAttemptWindow      = time.Hour
+	loginLockoutBase        = time.Minute
+	loginLockoutMax         = time.Hour
+)
+
+var errInvalidCredentials = apperror.Unauthorized("invalid_credentials", "Invalid credentials")
+
+// errLockedOut carries how long the client has to wait before trying again.
+type errLockedOut struct {
+	retryAfter time.Duration
+}
+
+func (e errLockedOut) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// compareDummyPassword spends the same time as checking a real password,
+// so a login for an unknown email cannot be told apart by its latency.
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = auth.HashPassword("free-learn-dummy-password")
+	})
+	auth.CheckPasswordHash(password, dummyHash)
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginLockout returns errLockedOut if any of the keys is locked.
+func checkLoginLockout(keys ...string) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LoginAttemptCollection)
+	now := time.Now()
+
+	var longest time.Duration
+	for _, key := range keys {
+		var attempt models.LoginAttempt
+		err := collection.FindOne(context.Background(), bson.M{"_id": key}).Decode(&attempt)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			return err
+		}
+		if wait := attempt.LockedUntil.Time().Sub(now); wait > longest {
+			longest = wait
+		}
+	}
+
+	if longest > 0 {
+		return errLockedOut{retryAfter: longest}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed attempt against the key and locks it
+// once it has too many.
+func recordLoginFailure(key string, threshold int) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LoginAttemptCollection)
+	now := time.Now()
+
+	var attempt models.LoginAttempt
+	err := collection.FindOne(context.Background(), bson.M{"_id": key}).Decode(&attempt)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	update := bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"last_failure": primitive.NewDateTimeFromTime(now)}}
+	if err == nil && now.Sub(attempt.LastFailure.Time()) > loginAttemptWindow {
+		update = bson.M{"$set": bson.M{"failures": 1, "last_failure": primitive.NewDateTimeFromTime(now)}}
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := collection.FindOneAndUpdate(context.Background(), bson.M{"_id": key}, update, opts).Decode(&attempt); err != nil {
+		return err
+	}
+
+	if attempt.Failures < threshold {
+		return nil
+	}
+
+	lockout := loginLockoutBase
+	for i := threshold; i < attempt.Failures && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > loginLockoutMax {
+		lockout = loginLockoutMax
+	}
+	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set": bson.M{"locked_until": primitive.NewDateTimeFromTime(now.Add(lockout))},
+	})
+	return err
+}
+
+// recordFailedLogin counts a failure against both the account and the
+// client address.
+func recordFailedLogin(email, ip string) error {
+	if err := recordLoginFailure(accountAttemptKey(email), accountFailureThreshold); err != nil {
+		return err
+	}
+	return recordLoginFailure(ipAttemptKey(ip), ipFailureThreshold)
+}
+
+// clearLoginFailures unlocks the account. The address counter is left to
+// expire on its own, so logging into an account of one's own does not
+// reset it.
+func clearLoginFailures(email string) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LoginAttemptCollection)
+	_, err := collection.DeleteOne(context.Background(), bson.M{"_id": accountAttemptKey(email)})
+	return err
+}
+
+// checkCurrentPassword re-checks the password of a signed-in user before a
+// sensitive change, writing the error response itself when it is wrong.
+// Wrong passwords count against the same lockout as logins, so a stolen
+// session cannot be used to guess the password.
+func checkCurrentPassword(c *gin.Context, user *models.User, password, detail string) bool {
+	if err := checkLoginLockout(accountAttemptKey(user.Email), ipAttemptKey(c.ClientIP())); err != nil {
+		respondLoginError(c, err)
+		return false
+	}
+
+	if !auth.CheckPasswordHash(password, user.Password) {
+		if err := recordFailedLogin(user.Email, c.ClientIP()); err != nil {
+			apperror.Respond(c, err)
+			return false
+		}
+		apperror.Respond(c, apperror.Unauthorized("incorrect_password", detail))
+		return false
+	}
+	return true
+}
+
+// respondLoginError maps login failures to responses that never reveal
+// whether the email is registered.
+func respondLoginError(c *gin.Context, err error) {
+	var locked errLockedOut
+	if errors.As(err, &locked) {
+		seconds := int(math.Ceil(locked.retryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		apperror.Respond(c, apperror.TooManyRequests("too_many_login_attempts", locked.Error()).With("retry_after", seconds))
+		return
+	}
+	apperror.Respond(c, err)
+}
@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type noteInput struct {
+	Body      string `json:"body" binding:"required,max=10000"`
+	Timestamp *int   `json:"timestamp" binding:"omitempty,min=0"`
+}
+
+type noteResponse struct {
+	Id        primitive.ObjectID  `json:"_id"`
+	Date      primitive.DateTime  `json:"date"`
+	CourseID  primitive.ObjectID  `json:"course_id"`
+	Lesson    models.LessonRef    `json:"lesson"`
+	Body      string              `json:"body"`
+	Timestamp *int                `json:"timestamp,omitempty"`
+	UpdatedAt *primitive.DateTime `json:"updated_at,omitempty"`
+}
+
+func noteResponseOf(note models.Note) noteResponse {
+	return noteResponse{
+		Id:        note.Id,
+		Date:      note.Date,
+		CourseID:  note.CourseID,
+		Lesson:    note.Lesson,
+		Body:      note.Body,
+		Timestamp: note.Timestamp,
+		UpdatedAt: note.UpdatedAt,
+	}
+}
+
+type bookmarkResponse struct {
+	Id       primitive.ObjectID `json:"_id"`
+	Date     primitive.DateTime `json:"date"`
+	CourseID primitive.ObjectID `json:"course_id"`
+	Lesson   models.LessonRef   `json:"lesson"`
+}
+
+func bookmarkResponseOf(bookmark models.Bookmark) bookmarkResponse {
+	return bookmarkResponse{
+		Id:       bookmark.Id,
+		Date:     bookmark.Date,
+		CourseID: bookmark.CourseID,
+		Lesson:   bookmark.Lesson,
+	}
+}
+
+func PostNote(c *gin.Context) {
+	userID, course, ref, ok := noteLessonFromParams(c)
+	if !ok {
+		return
+	}
+
+	var input noteInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !validNoteInput(c, input) {
+		return
+	}
+
+	note := models.Note{
+		Id:        primitive.NewObjectID(),
+		Date:      primitive.NewDateTimeFromTime(time.Now()),
+		UserID:    userID,
+		CourseID:  course.Id,
+		Lesson:    ref,
+		Body:      input.Body,
+		Timestamp: input.Timestamp,
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.NoteCollection, note)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, noteResponseOf(note))
+}
+
+func UpdateNote(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	noteID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_note_id", "Invalid note ID"))
+		return
+	}
+
+	var input noteInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !validNoteInput(c, input) {
+		return
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	update := bson.M{"$set": bson.M{"body": input.Body, "updated_at": now}}
+	if input.Timestamp != nil {
+		update["$set"].(bson.M)["timestamp"] = *input.Timestamp
+	} else {
+		update["$unset"] = bson.M{"timestamp": ""}
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.NoteCollection)
+	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": noteID, "user_id": userID}, update)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		apperror.Respond(c, apperror.NotFound("note_not_found", "Note not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Note updated successfully"})
+}
+
+func DeleteNote(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	noteID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_note_id", "Invalid note ID"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.NoteCollection)
+	result, err := collection.DeleteOne(context.Background(), bson.M{"_id": noteID, "user_id": userID})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		apperror.Respond(c, apperror.NotFound("note_not_found", "Note not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Note deleted successfully"})
+}
+
+// GetUserNotes lists the user's notes across all courses, or only one course
+// when the "course" query parameter is given.
+func GetUserNotes(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	filter, ok := userCourseFilter(c, userID.(primitive.ObjectID))
+	if !ok {
+		return
+	}
+
+	notes, err := findNotes(filter)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(notes, noteResponseOf))
+}
+
+func findNotes(filter bson.M) ([]models.Note, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.NoteCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "course_id", Value: 1}, {Key: "lesson.module", Value: 1}, {Key: "lesson.lesson", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "date", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	notes := []models.Note{}
+	if err = cursor.All(context.Background(), &notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// PostBookmark is idempotent: bookmarking a lesson twice keeps one bookmark.
+func PostBookmark(c *gin.Context) {
+	userID, course, ref, ok := noteLessonFromParams(c)
+	if !ok {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.BookmarkCollection)
+	filter := bson.M{"user_id": userID, "course_id": course.Id, "lesson": ref}
+	update := bson.M{"$setOnInsert": bson.M{
+		"_id":  primitive.NewObjectID(),
+		"date": primitive.NewDateTimeFromTime(time.Now()),
+	}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var bookmark models.Bookmark
+	if err := collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&bookmark); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, bookmarkResponseOf(bookmark))
+}
+
+func DeleteBookmark(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	_, moduleIndex, lessonIndex, ok := lessonFromParams(c, course)
+	if !ok {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.BookmarkCollection)
+	filter := bson.M{"user_id": userID, "course_id": course.Id, "lesson": models.LessonRef{Module: moduleIndex, Lesson: lessonIndex}}
+	if _, err := collection.DeleteOne(context.Background(), filter); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Bookmark removed successfully"})
+}
+
+func GetUserBookmarks(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	filter, ok := userCourseFilter(c, userID.(primitive.ObjectID))
+	if !ok {
+		return
+	}
+
+	bookmarks, err := findBookmarks(filter)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, responsesOf(bookmarks, bookmarkResponseOf))
+}
+
+func findBookmarks(filter bson.M) ([]models.Bookmark, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.BookmarkCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	bookmarks := []models.Bookmark{}
+	if err = cursor.All(context.Background(), &bookmarks); err != nil {
+		return nil, err
+	}
+	return bookmarks, nil
+}
+
+func ExportNotes(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	filter, ok := userCourseFilter(c, userID.(primitive.ObjectID))
+	if !ok {
+		return
+	}
+
+	markdown, err := exportNotesMarkdown(filter)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="notes.md"`)
+	c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(markdown))
+}
+
+// exportNotesMarkdown renders notes and bookmarks as one markdown document
+// with a section per course and a subsection per lesson, in course order.
+func exportNotesMarkdown(filter bson.M) (string, error) {
+	notes, err := findNotes(filter)
+	if err != nil {
+		return "", err
+	}
+
+	bookmarks, err := findBookmarks(filter)
+	if err != nil {
+		return "", err
+	}
+
+	type lessonEntry struct {
+		notes      []models.Note
+		bookmarked bool
+	}
+	byCourse := map[primitive.ObjectID]map[models.LessonRef]*lessonEntry{}
+	entry := func(courseID primitive.ObjectID, ref models.LessonRef) *lessonEntry {
+		if byCourse[courseID] == nil {
+			byCourse[courseID] = map[models.LessonRef]*lessonEntry{}
+		}
+		if byCourse[courseID][ref] == nil {
+			byCourse[courseID][ref] = &lessonEntry{}
+		}
+		return byCourse[courseID][ref]
+	}
+	for _, note := range notes {
+		e := entry(note.CourseID, note.Lesson)
+		e.notes = append(e.notes, note)
+	}
+	for _, bookmark := range bookmarks {
+		entry(bookmark.CourseID, bookmark.Lesson).bookmarked = true
+	}
+
+	courses := map[primitive.ObjectID]*models.Course{}
+	courseIDs := []primitive.ObjectID{}
+	for courseID := range byCourse {
+		course, err := getCourseByID(courseID)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return "", err
+		}
+		courses[courseID] = course
+		courseIDs = append(courseIDs, courseID)
+	}
+	sort.Slice(courseIDs, func(i, j int) bool {
+		return courseTitle(courses[courseIDs[i]]) < courseTitle(courses[courseIDs[j]])
+	})
+
+	var out strings.Builder
+	out.WriteString("# My notes\n")
+	for _, courseID := range courseIDs {
+		course := courses[courseID]
+		fmt.Fprintf(&out, "\n## %s\n", courseTitle(course))
+
+		refs := []models.LessonRef{}
+		for ref := range byCourse[courseID] {
+			refs = append(refs, ref)
+		}
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].Module != refs[j].Module {
+				return refs[i].Module < refs[j].Module
+			}
+			return refs[i].Lesson < refs[j].Lesson
+		})
+
+		for _, ref := range refs {
+			e := byCourse[courseID][ref]
+			title := lessonTitle(course, ref)
+			if e.bookmarked {
+				title += " (bookmarked)"
+			}
+			fmt.Fprintf(&out, "\n### %s\n\n", title)
+
+			for _, note := range e.notes {
+				if note.Timestamp != nil {
+					fmt.Fprintf(&out, "- **[%s]** %s\n", formatTimestamp(*note.Timestamp), indentMarkdown(note.Body))
+				} else {
+					fmt.Fprintf(&out, "- %s\n", indentMarkdown(note.Body))
+				}
+			}
+		}
+	}
+
+	return out.String(), nil
+}
+
+func courseTitle(course *models.Course) string {
+	if course == nil {
+		return "Deleted course"
+	}
+	return course.Name
+}
+
+func lessonTitle(course *models.Course, ref models.LessonRef) string {
+	if course != nil && ref.Module < len(course.Modules) && ref.Lesson < len(course.Modules[ref.Module].Lessons) {
+		return course.Modules[ref.Module].Name + " / " + course.Modules[ref.Module].Lessons[ref.Lesson].Name
+	}
+	return fmt.Sprintf("Module %d / Lesson %d", ref.Module+1, ref.Lesson+1)
+}
+
+// formatTimestamp turns a video position in seconds into h:mm:ss or m:ss.
+func formatTimestamp(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// indentMarkdown keeps multi-line notes inside their list item.
+func indentMarkdown(body string) string {
+	return strings.ReplaceAll(strings.TrimSpace(body), "\n", "\n  ")
+}
+
+func validNoteInput(c *gin.Context, input noteInput) bool {
+	if strings.TrimSpace(input.Body) == "" {
+		apperror.Respond(c, apperror.Validation("body_required", "Body is required"))
+		return false
+	}
+	return true
+}
+
+// noteLessonFromParams resolves the lesson a note or bookmark is attached to
+// and checks that the user may access it.
+func noteLessonFromParams(c *gin.Context) (primitive.ObjectID, *models.Course, models.LessonRef, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return primitive.NilObjectID, nil, models.LessonRef{}, false
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return primitive.NilObjectID, nil, models.LessonRef{}, false
+	}
+
+	_, moduleIndex, lessonIndex, ok := lessonFromParams(c, course)
+	if !ok {
+		return primitive.NilObjectID, nil, models.LessonRef{}, false
+	}
+
+	if !requireModuleAccess(c, userID.(primitive.ObjectID), course, moduleIndex) {
+		return primitive.NilObjectID, nil, models.LessonRef{}, false
+	}
+
+	return userID.(primitive.ObjectID), course, models.LessonRef{Module: moduleIndex, Lesson: lessonIndex}, true
+}
+
+func userCourseFilter(c *gin.Context, userID primitive.ObjectID) (bson.M, bool) {
+	filter := bson.M{"user_id": userID}
+	if courseID := c.Query("course"); courseID != "" {
+		courseObjectID, err := primitive.ObjectIDFromHex(courseID)
+		if err != nil {
+			apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
+			return nil, false
+		}
+		filter["course_id"] = courseObjectID
+	}
+	return filter, true
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	"github.com/phcarneirobc/free-learn/identity"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oidcStateExpiry         = 10 * time.Minute
+	externalLoginCodeExpiry = time.Minute
+)
+
+// oidcStateCookie holds a hash of the login state in the browser that
+// started the login, so a callback URL cannot be completed in another one.
+const oidcStateCookie = "oidc_state"
+
+const eventExternalIdentityLinked = "external_identity_linked"
+
+// providerErrors are the error codes of RFC 6749 section 4.1.2.1. The error
+// query parameter of a callback is only echoed back when it is one of
+// them, since anyone can craft a callback URL.
+var providerErrors = map[string]bool{
+	"invalid_request":           true,
+	"unauthorized_client":       true,
+	"access_denied":             true,
+	"unsupported_response_type": true,
+	"invalid_scope":             true,
+	"server_error":              true,
+	"temporarily_unavailable":   true,
+}
+
+var errUnverifiedEmail = apperror.Forbidden("unverified_email", "The identity provider has not verified this email address")
+
+var identityProviders = identity.NewRegistry()
+
+// externalLoginRedirect is the frontend page the callback sends the browser
+// back to, with a one-time code to exchange for a session.
+var externalLoginRedirect *url.URL
+
+// ConfigureIdentityProviders sets the OpenID Connect providers users can
+// log in with and the frontend page a completed login returns to, which
+// is required once any provider is configured.
+func ConfigureIdentityProviders(registry *identity.Registry, loginRedirectURL string) error {
+	if len(registry.Names()) > 0 {
+		redirect, err := url.Parse(loginRedirectURL)
+		if err != nil || !redirect.IsAbs() {
+			return errors.New("OIDC_LOGIN_REDIRECT_URL must be an absolute URL when OIDC_PROVIDERS is set")
+		}
+		externalLoginRedirect = redirect
+	}
+	identityProviders = registry
+	return nil
+}
+
+type identityProviderList struct {
+	Providers []string `json:"providers"`
+}
+
+func GetIdentityProviders(c *gin.Context) {
+	names := identityProviders.Names()
+	sort.Strings(names)
+	c.JSON(http.StatusOK, identityProviderList{Providers: names})
+}
+
+// StartExternalLogin redirects the user to the provider's login page.
+func StartExternalLogin(c *gin.Context) {
+	provider, ok := identityProviderFromParam(c)
+	if !ok {
+		return
+	}
+
+	request := provider.NewAuthRequest()
+	state := models.OIDCState{
+		State:    request.State,
+		Date:     primitive.NewDateTimeFromTime(time.Now()),
+		Provider: c.Param("provider"),
+		Nonce:    request.Nonce,
+		Verifier: request.Verifier,
+	}
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.OIDCStateCollection, state)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	setStateCookie(c, auth.HashOpaqueToken(request.State), int(oidcStateExpiry.Seconds()))
+	c.Redirect(http.StatusFound, request.URL)
+}
+
+// ExternalLoginCallback completes the login the provider redirected back
+// from, finding the linked account or creating one. The browser is sent on
+// to the frontend with a one-time code, since a page reached through a
+// redirect cannot hand a token to the frontend itself.
+func ExternalLoginCallback(c *gin.Context) {
+	if providerError := c.Query("error"); providerError != "" {
+		problem := apperror.Unauthorized("external_login_failed", "The login at the identity provider was not completed")
+		if providerErrors[providerError] {
+			problem = problem.With("provider_error", providerError)
+		}
+		apperror.Respond(c, problem)
+		return
+	}
+
+	provider, ok := identityProviderFromParam(c)
+	if !ok {
+		return
+	}
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	setStateCookie(c, "", -1)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(auth.HashOpaqueToken(c.Query("state")))) != 1 {
+		apperror.Respond(c, apperror.Validation("invalid_login_state", "Invalid or expired login state"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.OIDCStateCollection)
+	var state models.OIDCState
+	err = collection.FindOneAndDelete(context.Background(), bson.M{"_id": c.Query("state"), "provider": c.Param("provider")}).Decode(&state)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.Validation("invalid_login_state", "Invalid or expired login state"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+	if time.Since(state.Date.Time()) > oidcStateExpiry {
+		apperror.Respond(c, apperror.Validation("invalid_login_state", "Invalid or expired login state"))
+		return
+	}
+
+	request := identity.AuthRequest{State: state.State, Nonce: state.Nonce, Verifier: state.Verifier}
+	external, err := provider.Exchange(c.Request.Context(), request, c.Query("code"))
+	if err != nil {
+		log.Printf("oidc: exchanging code with %s: %v", c.Param("provider"), err)
+		apperror.Respond(c, apperror.Unauthorized("external_login_failed", "The identity provider did not confirm the login"))
+		return
+	}
+
+	user, linked, err := userForIdentity(external)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if linked {
+		recordSecurityEvent(c, user.Id, eventExternalIdentityLinked)
+	}
+
+	code, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	login := models.ExternalLogin{
+		CodeHash: auth.HashOpaqueToken(code),
+		Date:     primitive.NewDateTimeFromTime(time.Now()),
+		UserID:   user.Id,
+	}
+	_, err = db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.ExternalLoginCollection, login)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, externalLoginRedirectURL(externalLoginRedirect, code))
+}
+
+// externalLoginRedirectURL adds the one-time code to the frontend page,
+// keeping any query it already has.
+func externalLoginRedirectURL(redirect *url.URL, code string) string {
+	target := *redirect
+	query := target.Query()
+	query.Set("code", code)
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+type exchangeExternalLoginInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ExchangeExternalLogin is how the frontend finishes an external login:
+// it trades the code the callback redirected it with for the same
+// response as Login. Each code works once, within a minute.
+func ExchangeExternalLogin(c *gin.Context) {
+	var input exchangeExternalLoginInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.ExternalLoginCollection)
+	var login models.ExternalLogin
+	err := collection.FindOneAndDelete(context.Background(), bson.M{"_id": auth.HashOpaqueToken(input.Code)}).Decode(&login)
+	if err != nil && err != mongo.ErrNoDocuments {
+		apperror.Respond(c, err)
+		return
+	}
+	if err == mongo.ErrNoDocuments || time.Since(login.Date.Time()) > externalLoginCodeExpiry {
+		apperror.Respond(c, apperror.Unauthorized("invalid_login_code", "Invalid or expired login code"))
+		return
+	}
+
+	user, err := getUserByID(login.UserID)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	response, err := completeLogin(c, *user)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, loginResult{Token: response})
+}
+
+// setStateCookie sets the login state cookie, or clears it when maxAge is
+// negative. It is sent back on the provider's top-level redirect to the
+// callback, which SameSite=Lax allows.
+func setStateCookie(c *gin.Context, value string, maxAge int) {
+	secure := c.Request.TLS != nil || strings.HasPrefix(os.Getenv("PUBLIC_URL"), "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, "/", "", secure, true)
+}
+
+func identityProviderFromParam(c *gin.Context) (*identity.Provider, bool) {
+	provider, err := identityProviders.Provider(c.Request.Context(), c.Param("provider"))
+	if err != nil {
+		if err == identity.ErrUnknownProvider {
+			apperror.Respond(c, apperror.NotFound("identity_provider_not_found", "Identity provider not found"))
+			return nil, false
+		}
+		apperror.Respond(c, apperror.Unavailable("identity_provider_unavailable", "The identity provider could not be reached", err))
+		return nil, false
+	}
+	return provider, true
+}
+
+// userForIdentity finds the account an external identity belongs to. An
+// identity seen for the first time is linked to the account with the same
+// email, or gets a new account, but only if the provider verified that
+// email; otherwise anyone could claim an existing account by using an
+// unverified address at some provider. linked reports whether the
+// identity was just linked to an existing account.
+func userForIdentity(external *identity.Identity) (*models.User, bool, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+
+	var user models.User
+	err := collection.FindOne(context.Background(), bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"issuer":  external.Issuer,
+		"subject": external.Subject,
+	}}}).Decode(&user)
+	if err == nil {
+		return &user, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	if external.Email == "" || !external.EmailVerified {
+		return nil, false, errUnverifiedEmail
+	}
+
+	link := models.ExternalIdentity{
+		Provider: external.Provider,
+		Issuer:   external.Issuer,
+		Subject:  external.Subject,
+	}
+
+	existing, err := getUserByEmail(external.Email)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil {
+		if err := updateUserByID(existing.Id, bson.M{"$addToSet": bson.M{"identities": link}}); err != nil {
+			return nil, false, err
+		}
+		existing.Identities = append(existing.Identities, link)
+		return existing, true, nil
+	}
+
+	// Accounts created here have no password; CheckPasswordHash never
+	// matches an empty hash, so they can only log in through a provider
+	// until a password is set with the reset flow.
+	created := models.User{
+		Id:          primitive.NewObjectID(),
+		Date:        primitive.NewDateTimeFromTime(time.Now()),
+		Email:       external.Email,
+		DisplayName: external.Name,
+		Cursos:      []primitive.ObjectID{},
+		Paths:       []primitive.ObjectID{},
+		Identities:  []models.ExternalIdentity{link},
+	}
+	_, err = db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.UserCollection, created)
+	if err != nil {
+		return nil, false, err
+	}
+	return &created, false, nil
+}
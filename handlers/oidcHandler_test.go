@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/identity"
+)
+
+func TestExternalLoginRedirectCarriesTheCode(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{"https://app.example.com/login/done", "https://app.example.com/login/done?code=abc"},
+		{"https://app.example.com/login?next=%2Fcourses", "https://app.example.com/login?code=abc&next=%2Fcourses"},
+		{"https://app.example.com/login?code=stale", "https://app.example.com/login?code=abc"},
+	}
+	for _, tt := range tests {
+		redirect, err := url.Parse(tt.redirect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := externalLoginRedirectURL(redirect, "abc"); got != tt.want {
+			t.Errorf("externalLoginRedirectURL(%q) = %q, want %q", tt.redirect, got, tt.want)
+		}
+	}
+}
+
+func TestProvidersNeedALoginRedirect(t *testing.T) {
+	registry := identity.NewRegistry(identity.ProviderConfig{Name: "example", IssuerURL: "https://id.example.com"})
+	for _, redirect := range []string{"", "/login/done", "://"} {
+		if err := ConfigureIdentityProviders(registry, redirect); err == nil {
+			t.Errorf("ConfigureIdentityProviders accepted the redirect %q", redirect)
+		}
+	}
+	if err := ConfigureIdentityProviders(identity.NewRegistry(), ""); err != nil {
+		t.Errorf("ConfigureIdentityProviders without providers: %v", err)
+	}
+}
+
+func TestCallbackErrorIsNotEchoed(t *testing.T) {
+	tests := []struct {
+		query   string
+		echoed  bool
+		message string
+	}{
+		{"access_denied", true, "access_denied"},
+		{"Your+account+was+suspended,+call+555-0100", false, "555-0100"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/auth/oidc/callback/example?error="+tt.query, nil)
+
+		ExternalLoginCallback(c)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("error=%s: status %d, want %d", tt.query, recorder.Code, http.StatusUnauthorized)
+		}
+		if echoed := strings.Contains(recorder.Body.String(), tt.message); echoed != tt.echoed {
+			t.Errorf("error=%s: echoed = %v, want %v: %s", tt.query, echoed, tt.echoed, recorder.Body.String())
+		}
+	}
+}
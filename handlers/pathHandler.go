@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type pathProgress struct {
+	PathID           primitive.ObjectID  `json:"path_id"`
+	Courses          []courseStatus      `json:"courses"`
+	CompletedCourses int                 `json:"completed_courses"`
+	TotalCourses     int                 `json:"total_courses"`
+	Percent          int                 `json:"percent"`
+	NextCourse       *primitive.ObjectID `json:"next_course"`
+	Completed        bool                `json:"completed"`
+}
+
+type pathResponse struct {
+	Id          primitive.ObjectID   `json:"_id"`
+	Date        primitive.DateTime   `json:"date"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	CreatorID   primitive.ObjectID   `json:"creator_id"`
+	Courses     []primitive.ObjectID `json:"courses"`
+	Published   bool                 `json:"published"`
+}
+
+func pathResponseOf(path models.LearningPath) pathResponse {
+	return pathResponse{
+		Id:          path.Id,
+		Date:        path.Date,
+		Name:        path.Name,
+		Description: path.Description,
+		CreatorID:   path.CreatorID,
+		Courses:     path.Courses,
+		Published:   path.Published,
+	}
+}
+
+type pathInput struct {
+	Name        string               `json:"name" binding:"required,max=200"`
+	Description string               `json:"description" binding:"max=5000"`
+	Courses     []primitive.ObjectID `json:"courses" binding:"max=50"`
+}
+
+func GetLearningPaths(c *gin.Context) {
+	paths, err := findLearningPaths(bson.M{"published": true})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, responsesOf(paths, pathResponseOf))
+}
+
+func findLearningPaths(filter bson.M) ([]models.LearningPath, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LearningPathCollection)
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	paths := []models.LearningPath{}
+	if err = cursor.All(context.Background(), &paths); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func GetLearningPathByID(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	path, ok := pathFromParam(c)
+	if !ok {
+		return
+	}
+
+	// Drafts are only visible to their creator.
+	if !path.Published && path.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.NotFound("learning_path_not_found", "Learning path not found"))
+		return
+	}
+
+	c.JSON(http.StatusOK, pathResponseOf(*path))
+}
+
+func PostLearningPath(c *gin.Context) {
+	var input pathInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	if err := validatePathInput(input); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	path := models.LearningPath{
+		Id:          primitive.NewObjectID(),
+		Date:        primitive.NewDateTimeFromTime(time.Now()),
+		Name:        input.Name,
+		Description: input.Description,
+		CreatorID:   userID.(primitive.ObjectID),
+		Courses:     input.Courses,
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.LearningPathCollection, path)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, pathResponseOf(path))
+}
+
+func UpdateLearningPath(c *gin.Context) {
+	path, ok := ownedPathFromParam(c)
+	if !ok {
+		return
+	}
+
+	var input pathInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if err := validatePathInput(input); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if path.Published && len(input.Courses) == 0 {
+		apperror.Respond(c, apperror.Validation("empty_learning_path", "A published learning path needs at least one course"))
+		return
+	}
+
+	err := updateLearningPath(path.Id, bson.M{
+		"name":        input.Name,
+		"description": input.Description,
+		"courses":     input.Courses,
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Learning path updated successfully"})
+}
+
+func PublishLearningPath(c *gin.Context) {
+	path, ok := ownedPathFromParam(c)
+	if !ok {
+		return
+	}
+
+	if len(path.Courses) == 0 {
+		apperror.Respond(c, apperror.Validation("empty_learning_path", "A learning path needs at least one course to be published"))
+		return
+	}
+
+	if err := updateLearningPath(path.Id, bson.M{"published": true}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Learning path published successfully"})
+}
+
+func updateLearningPath(id primitive.ObjectID, updateData bson.M) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LearningPathCollection)
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": updateData})
+	return err
+}
+
+func DeleteLearningPath(c *gin.Context) {
+	path, ok := ownedPathFromParam(c)
+	if !ok {
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LearningPathCollection)
+	if _, err := collection.DeleteOne(context.Background(), bson.M{"_id": path.Id}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Learning path deleted successfully"})
+}
+
+// EnrollInLearningPath enrolls the user in the path and in every course it
+// contains. It is refused when a course is archived or has a prerequisite
+// the user has not completed and that does not come earlier on the path;
+// those earlier on the path are left to lesson access, which enforces
+// them course by course.
+func EnrollInLearningPath(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	path, ok := pathFromParam(c)
+	if !ok {
+		return
+	}
+
+	if !path.Published {
+		apperror.Respond(c, apperror.NotFound("learning_path_not_found", "Learning path not found"))
+		return
+	}
+
+	if err := enrollInLearningPath(userID.(primitive.ObjectID), path); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Enrolled in learning path successfully"})
+}
+
+// enrollInLearningPath enrolls the user in the path and every course on it,
+// or in none of them when a course may not be enrolled in. Prerequisites
+// that come earlier on the path do not block enrollment: taking the path in
+// order completes them, and requireModuleAccess keeps the course locked
+// until then.
+func enrollInLearningPath(userID primitive.ObjectID, path *models.LearningPath) error {
+	courses := []primitive.ObjectID{}
+	onPath := map[primitive.ObjectID]bool{}
+	for _, courseID := range path.Courses {
+		course, err := getCourseByID(courseID)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if course.Archived {
+			return apperror.Forbidden("course_archived", "A course on this path is archived and no longer accepts enrollments").
+				With("course_id", course.Id)
+		}
+
+		missing, err := missingPrerequisites(userID, course)
+		if err != nil {
+			return err
+		}
+		blocking := []primitive.ObjectID{}
+		for _, prerequisiteID := range missing {
+			if !onPath[prerequisiteID] {
+				blocking = append(blocking, prerequisiteID)
+			}
+		}
+		if len(blocking) > 0 {
+			return errPrerequisitesMissing(blocking).With("course_id", course.Id)
+		}
+
+		onPath[course.Id] = true
+		courses = append(courses, course.Id)
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	update := bson.M{"$addToSet": bson.M{
+		"paths":  path.Id,
+		"cursos": bson.M{"$each": courses},
+	}}
+	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": userID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return apperror.NotFound("user_not_found", "User not found")
+	}
+	return nil
+}
+
+func GetLearningPathProgress(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	path, ok := pathFromParam(c)
+	if !ok {
+		return
+	}
+
+	if !path.Published && path.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.NotFound("learning_path_not_found", "Learning path not found"))
+		return
+	}
+
+	progress, err := getLearningPathProgress(userID.(primitive.ObjectID), path)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, progress)
+}
+
+// getLearningPathProgress aggregates per-course progress. The percentage is
+// weighted by lesson count so a long course counts for more than a short one.
+func getLearningPathProgress(userID primitive.ObjectID, path *models.LearningPath) (pathProgress, error) {
+	progress := pathProgress{PathID: path.Id, Courses: []courseStatus{}}
+
+	completedLessons, totalLessons := 0, 0
+	for _, courseID := range path.Courses {
+		course, err := getCourseByID(courseID)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return pathProgress{}, err
+		}
+
+		status, err := getCourseStatus(userID, course)
+		if err != nil {
+			return pathProgress{}, err
+		}
+
+		progress.Courses = append(progress.Courses, status)
+		progress.TotalCourses++
+		completedLessons += len(status.CompletedLessons)
+		totalLessons += status.TotalLessons
+		if status.Completed {
+			progress.CompletedCourses++
+		} else if progress.NextCourse == nil {
+			id := course.Id
+			progress.NextCourse = &id
+		}
+	}
+
+	if totalLessons > 0 {
+		progress.Percent = completedLessons * 100 / totalLessons
+	}
+	progress.Completed = progress.TotalCourses > 0 && progress.CompletedCourses == progress.TotalCourses
+
+	return progress, nil
+}
+
+func validatePathInput(input pathInput) error {
+	seen := map[primitive.ObjectID]bool{}
+	for _, courseID := range input.Courses {
+		if seen[courseID] {
+			return invalidField("courses", "unique", fmt.Sprintf("course %s appears more than once", courseID.Hex()))
+		}
+		seen[courseID] = true
+
+		_, err := getCourseByID(courseID)
+		if err == mongo.ErrNoDocuments {
+			return invalidField("courses", "exists", fmt.Sprintf("course %s not found", courseID.Hex()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pathFromParam(c *gin.Context) (*models.LearningPath, bool) {
+	pathID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_learning_path_id", "Invalid learning path ID"))
+		return nil, false
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.LearningPathCollection)
+	var path models.LearningPath
+	err = collection.FindOne(context.Background(), bson.M{"_id": pathID}).Decode(&path)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("learning_path_not_found", "Learning path not found"))
+			return nil, false
+		}
+		apperror.Respond(c, err)
+		return nil, false
+	}
+
+	return &path, true
+}
+
+// ownedPathFromParam is pathFromParam restricted to the path's creator.
+func ownedPathFromParam(c *gin.Context) (*models.LearningPath, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return nil, false
+	}
+
+	path, ok := pathFromParam(c)
+	if !ok {
+		return nil, false
+	}
+
+	if path.CreatorID != userID.(primitive.ObjectID) {
+		apperror.Respond(c, apperror.Forbidden("not_learning_path_creator", "User is not the creator of the learning path"))
+		return nil, false
+	}
+
+	return path, true
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/language"
+)
+
+type profile struct {
+	Id          primitive.ObjectID `json:"_id"`
+	Email       string             `json:"email"`
+	Professor   bool               `json:"professor"`
+	DisplayName string             `json:"display_name"`
+	Bio         string             `json:"bio"`
+	Avatar      string             `json:"avatar"`
+	Links       []string           `json:"links"`
+	Locale      string             `json:"locale"`
+	Timezone    string             `json:"timezone"`
+}
+
+type profileInput struct {
+	DisplayName string   `json:"display_name" binding:"max=80"`
+	Bio         string   `json:"bio" binding:"max=2000"`
+	Avatar      string   `json:"avatar" binding:"omitempty,http_url,max=2048"`
+	Links       []string `json:"links" binding:"max=10,dive,http_url,max=2048"`
+	Locale      string   `json:"locale"`
+	Timezone    string   `json:"timezone"`
+}
+
+type ratingAggregate struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+type instructorCourse struct {
+	Id          primitive.ObjectID `json:"_id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Image       string             `json:"image"`
+	Rating      ratingAggregate    `json:"rating"`
+}
+
+// creatorSummary is the public profile of a course creator shown with
+// the course.
+type creatorSummary struct {
+	Id          primitive.ObjectID `json:"_id"`
+	DisplayName string             `json:"display_name"`
+	Avatar      string             `json:"avatar"`
+}
+
+// instructorProfile is the public page of a course creator. It never
+// includes the instructor's email address.
+type instructorProfile struct {
+	Id          primitive.ObjectID `json:"_id"`
+	DisplayName string             `json:"display_name"`
+	Bio         string             `json:"bio"`
+	Avatar      string             `json:"avatar"`
+	Links       []string           `json:"links"`
+	Courses     []instructorCourse `json:"courses"`
+	Rating      ratingAggregate    `json:"rating"`
+}
+
+func GetProfile(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	user, err := getUserByID(userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, profileOf(user))
+}
+
+func UpdateProfile(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	var input profileInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	input.DisplayName = strings.TrimSpace(input.DisplayName)
+	if err := validateProfile(&input); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	update := bson.M{"$set": bson.M{
+		"display_name": input.DisplayName,
+		"bio":          input.Bio,
+		"avatar":       input.Avatar,
+		"links":        input.Links,
+		"locale":       input.Locale,
+		"timezone":     input.Timezone,
+	}}
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": userID}, update); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	user, err := getUserByID(userID.(primitive.ObjectID))
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, profileOf(user))
+}
+
+// validateProfile checks the locale and time zone, which struct tags
+// cannot, and normalizes the locale to its canonical BCP 47 form.
+func validateProfile(input *profileInput) error {
+	if input.Locale != "" {
+		tag, err := language.Parse(input.Locale)
+		if err != nil {
+			return invalidField("locale", "bcp47", "must be a valid language tag")
+		}
+		input.Locale = tag.String()
+	}
+	if input.Timezone != "" {
+		if _, err := time.LoadLocation(input.Timezone); err != nil {
+			return invalidField("timezone", "timezone", "must be a known IANA time zone")
+		}
+	}
+	return nil
+}
+
+// GetInstructorProfile is the public page of a course creator. It never
+// includes the instructor's email address.
+func GetInstructorProfile(c *gin.Context) {
+	instructorID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_instructor_id", "Invalid instructor ID"))
+		return
+	}
+
+	user, err := getUserByID(instructorID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("instructor_not_found", "Instructor not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	if !user.Professor {
+		apperror.Respond(c, apperror.NotFound("instructor_not_found", "Instructor not found"))
+		return
+	}
+
+	courses, err := findCourses(bson.M{"creator_id": user.Id, "archived": bson.M{"$ne": true}})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	overall := ratingAggregate{}
+	total := 0
+	listed := []instructorCourse{}
+	for _, course := range courses {
+		rating := aggregateRatings(course.Ratings)
+		listed = append(listed, instructorCourse{
+			Id:          course.Id,
+			Name:        course.Name,
+			Description: course.Description,
+			Image:       course.Image,
+			Rating:      rating,
+		})
+		for _, r := range course.Ratings {
+			total += r.Score
+		}
+		overall.Count += rating.Count
+	}
+	if overall.Count > 0 {
+		overall.Average = float64(total) / float64(overall.Count)
+	}
+
+	c.JSON(http.StatusOK, instructorProfile{
+		Id:          user.Id,
+		DisplayName: displayName(user),
+		Bio:         user.Bio,
+		Avatar:      user.Avatar,
+		Links:       nonNilLinks(user.Links),
+		Courses:     listed,
+		Rating:      overall,
+	})
+}
+
+func aggregateRatings(ratings []models.Rating) ratingAggregate {
+	aggregate := ratingAggregate{Count: len(ratings)}
+	if len(ratings) == 0 {
+		return aggregate
+	}
+
+	total := 0
+	for _, rating := range ratings {
+		total += rating.Score
+	}
+	aggregate.Average = float64(total) / float64(len(ratings))
+	return aggregate
+}
+
+func findCourses(filter bson.M) ([]models.Course, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.CourseCollection)
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	courses := []models.Course{}
+	if err = cursor.All(context.Background(), &courses); err != nil {
+		return nil, err
+	}
+	return courses, nil
+}
+
+// attachCreators fills in the creator summary of every course with a single
+// query for all distinct creators.
+func attachCreators(courses []courseResponse) error {
+	ids := []primitive.ObjectID{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, course := range courses {
+		if !seen[course.CreatorID] {
+			seen[course.CreatorID] = true
+			ids = append(ids, course.CreatorID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	cursor, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var users []models.User
+	if err = cursor.All(context.Background(), &users); err != nil {
+		return err
+	}
+
+	summaries := map[primitive.ObjectID]*creatorSummary{}
+	for i := range users {
+		summaries[users[i].Id] = &creatorSummary{
+			Id:          users[i].Id,
+			DisplayName: displayName(&users[i]),
+			Avatar:      users[i].Avatar,
+		}
+	}
+	for i := range courses {
+		courses[i].Creator = summaries[courses[i].CreatorID]
+	}
+	return nil
+}
+
+func profileOf(user *models.User) profile {
+	return profile{
+		Id:          user.Id,
+		Email:       user.Email,
+		Professor:   user.Professor,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		Avatar:      user.Avatar,
+		Links:       nonNilLinks(user.Links),
+		Locale:      user.Locale,
+		Timezone:    user.Timezone,
+	}
+}
+
+// displayName is the name shown to other users. Accounts without one fall
+// back to the part of their email before the "@", so the full address is
+// never published.
+func displayName(user *models.User) string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	name, _, _ := strings.Cut(user.Email, "@")
+	return name
+}
+
+func nonNilLinks(links []string) []string {
+	if links == nil {
+		return []string{}
+	}
+	return links
+}
@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Codes of the 403 sent when a learner may not open a lesson.
+const (
+	reasonNotEnrolled          = "not_enrolled"
+	reasonPrerequisitesMissing = "prerequisites_incomplete"
+	reasonModuleLocked         = "module_locked"
+)
+
+// errPrerequisitesMissing lists the courses still to complete in the
+// missing_prerequisites member of the problem.
+func errPrerequisitesMissing(missing []primitive.ObjectID) *apperror.Error {
+	return apperror.Forbidden(reasonPrerequisitesMissing, "Prerequisite courses must be completed first").
+		With("missing_prerequisites", missing)
+}
+
+type courseStatus struct {
+	CourseID         primitive.ObjectID `json:"course_id"`
+	CompletedLessons []models.LessonRef `json:"completed_lessons"`
+	TotalLessons     int                `json:"total_lessons"`
+	Percent          int                `json:"percent"`
+	PassedQuizzes    []int              `json:"passed_quizzes"`
+	UnlockedModules  []int              `json:"unlocked_modules"`
+	Completed        bool               `json:"completed"`
+
+	Certificate *certificateResponse `json:"certificate,omitempty"`
+}
+
+func GetCourseProgress(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	status, err := getCourseStatus(userID.(primitive.ObjectID), course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func CompleteLesson(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return
+	}
+
+	_, moduleIndex, lessonIndex, ok := lessonFromParams(c, course)
+	if !ok {
+		return
+	}
+
+	if !requireModuleAccess(c, userID.(primitive.ObjectID), course, moduleIndex) {
+		return
+	}
+
+	ref := models.LessonRef{Module: moduleIndex, Lesson: lessonIndex}
+	if err := markLessonComplete(userID.(primitive.ObjectID), course.Id, ref); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	status, err := getCourseStatus(userID.(primitive.ObjectID), course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	certificate, err := issueCertificateIfCompleted(userID.(primitive.ObjectID), course, status)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	status.Certificate = issuedCertificate(certificate)
+
+	c.JSON(http.StatusOK, status)
+}
+
+func markLessonComplete(userID, courseID primitive.ObjectID, ref models.LessonRef) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.ProgressCollection)
+	filter := bson.M{"user_id": userID, "course_id": courseID}
+	update := bson.M{
+		"$addToSet":    bson.M{"completed_lessons": ref},
+		"$set":         bson.M{"date": primitive.NewDateTimeFromTime(time.Now())},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+	_, err := collection.UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// getProgress returns the user's progress in a course, or an empty record if
+// they have not completed anything yet.
+func getProgress(userID, courseID primitive.ObjectID) (*models.Progress, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.ProgressCollection)
+	var progress models.Progress
+	err := collection.FindOne(context.Background(), bson.M{"user_id": userID, "course_id": courseID}).Decode(&progress)
+	if err == mongo.ErrNoDocuments {
+		return &models.Progress{UserID: userID, CourseID: courseID, CompletedLessons: []models.LessonRef{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// passedQuizModules returns the indexes of the modules whose quiz the user
+// has passed at least once.
+func passedQuizModules(userID, courseID primitive.ObjectID) (map[int]bool, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.QuizAttemptCollection)
+	modules, err := collection.Distinct(context.Background(), "module", bson.M{"user_id": userID, "course_id": courseID, "passed": true})
+	if err != nil {
+		return nil, err
+	}
+
+	passed := map[int]bool{}
+	for _, module := range modules {
+		switch m := module.(type) {
+		case int32:
+			passed[int(m)] = true
+		case int64:
+			passed[int(m)] = true
+		}
+	}
+	return passed, nil
+}
+
+func getCourseStatus(userID primitive.ObjectID, course *models.Course) (courseStatus, error) {
+	progress, err := getProgress(userID, course.Id)
+	if err != nil {
+		return courseStatus{}, err
+	}
+
+	passed, err := passedQuizModules(userID, course.Id)
+	if err != nil {
+		return courseStatus{}, err
+	}
+
+	return computeCourseStatus(course, progress, passed), nil
+}
+
+// computeCourseStatus derives completion and unlocked modules. A course is
+// completed once every lesson is done and every quiz has been passed; lessons
+// that no longer exist after an edit are ignored.
+func computeCourseStatus(course *models.Course, progress *models.Progress, passed map[int]bool) courseStatus {
+	done := map[models.LessonRef]bool{}
+	for _, ref := range progress.CompletedLessons {
+		if ref.Module < len(course.Modules) && ref.Lesson < len(course.Modules[ref.Module].Lessons) {
+			done[ref] = true
+		}
+	}
+
+	status := courseStatus{
+		CourseID:         course.Id,
+		CompletedLessons: []models.LessonRef{},
+		PassedQuizzes:    []int{},
+		UnlockedModules:  []int{},
+	}
+
+	allQuizzesPassed := true
+	for i, module := range course.Modules {
+		status.TotalLessons += len(module.Lessons)
+		for j := range module.Lessons {
+			ref := models.LessonRef{Module: i, Lesson: j}
+			if done[ref] {
+				status.CompletedLessons = append(status.CompletedLessons, ref)
+			}
+		}
+
+		if module.Quiz != nil {
+			if passed[i] {
+				status.PassedQuizzes = append(status.PassedQuizzes, i)
+			} else {
+				allQuizzesPassed = false
+			}
+		}
+
+		if moduleUnlocked(course, i, done, passed) {
+			status.UnlockedModules = append(status.UnlockedModules, i)
+		}
+	}
+
+	if status.TotalLessons > 0 {
+		status.Percent = len(status.CompletedLessons) * 100 / status.TotalLessons
+	}
+	status.Completed = status.TotalLessons > 0 && len(status.CompletedLessons) == status.TotalLessons && allQuizzesPassed
+
+	return status
+}
+
+// moduleUnlocked reports whether module index may be opened. Without
+// sequential gating every module is open; with it, a module opens once the
+// previous module's lessons are all done or its quiz has been passed.
+func moduleUnlocked(course *models.Course, index int, done map[models.LessonRef]bool, passed map[int]bool) bool {
+	if !course.SequentialGating || index == 0 {
+		return true
+	}
+
+	previous := index - 1
+	if course.Modules[previous].Quiz != nil && passed[previous] {
+		return true
+	}
+
+	for j := range course.Modules[previous].Lessons {
+		if !done[models.LessonRef{Module: previous, Lesson: j}] {
+			return false
+		}
+	}
+	return true
+}
+
+// requireModuleAccess checks that the user may open a module of the course,
+// writing a 403 with the reason when they may not. The course creator
+// always has access.
+func requireModuleAccess(c *gin.Context, userID primitive.ObjectID, course *models.Course, moduleIndex int) bool {
+	if course.CreatorID == userID {
+		return true
+	}
+
+	enrolled, err := isEnrolled(userID, course.Id)
+	if err != nil {
+		apperror.Respond(c, err)
+		return false
+	}
+	if !enrolled {
+		apperror.Respond(c, apperror.Forbidden(reasonNotEnrolled, "User is not enrolled in this course"))
+		return false
+	}
+
+	missing, err := missingPrerequisites(userID, course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return false
+	}
+	if len(missing) > 0 {
+		apperror.Respond(c, errPrerequisitesMissing(missing))
+		return false
+	}
+
+	if !course.SequentialGating || moduleIndex == 0 {
+		return true
+	}
+
+	status, err := getCourseStatus(userID, course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return false
+	}
+	for _, unlocked := range status.UnlockedModules {
+		if unlocked == moduleIndex {
+			return true
+		}
+	}
+
+	apperror.Respond(c, apperror.Forbidden(reasonModuleLocked, "Complete the previous module or pass its quiz to unlock this module").With("module", moduleIndex))
+	return false
+}
+
+// missingPrerequisites returns the prerequisite courses the user has not
+// completed yet. Prerequisites that were deleted are not required anymore.
+func missingPrerequisites(userID primitive.ObjectID, course *models.Course) ([]primitive.ObjectID, error) {
+	missing := []primitive.ObjectID{}
+	for _, prerequisiteID := range course.Prerequisites {
+		prerequisite, err := getCourseByID(prerequisiteID)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		status, err := getCourseStatus(userID, prerequisite)
+		if err != nil {
+			return nil, err
+		}
+		if !status.Completed {
+			missing = append(missing, prerequisiteID)
+		}
+	}
+	return missing, nil
+}
+
+// validatePrerequisites checks that every prerequisite exists and that
+// courseID cannot be reached by following prerequisites, which would make
+// the courses impossible to start.
+func validatePrerequisites(courseID primitive.ObjectID, prerequisites []primitive.ObjectID) error {
+	for _, id := range prerequisites {
+		_, err := getCourseByID(id)
+		if err == mongo.ErrNoDocuments {
+			return invalidField("prerequisites", "exists", fmt.Sprintf("prerequisite course %s not found", id.Hex()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	visited := map[primitive.ObjectID]bool{}
+	queue := append([]primitive.ObjectID(nil), prerequisites...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == courseID {
+			return invalidField("prerequisites", "acyclic", "prerequisites would create a cycle")
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+
+		course, err := getCourseByID(id)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		queue = append(queue, course.Prerequisites...)
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type quizSummary struct {
+	AttemptsUsed      int  `json:"attempts_used"`
+	AttemptsRemaining *int `json:"attempts_remaining"`
+	KeptScore         *int `json:"kept_score"`
+	Passed            bool `json:"passed"`
+}
+
+type quizOverview struct {
+	Quiz    models.Quiz `json:"quiz"`
+	Summary quizSummary `json:"summary"`
+}
+
+// quizResult is the outcome of an attempt. Certificate is set when the
+// attempt completed the course.
+type quizResult struct {
+	Score       int                  `json:"score"`
+	Passed      bool                 `json:"passed"`
+	Summary     quizSummary          `json:"summary"`
+	Certificate *certificateResponse `json:"certificate"`
+}
+
+func GetQuiz(c *gin.Context) {
+	userID, course, moduleIndex, quiz, ok := quizFromParams(c)
+	if !ok {
+		return
+	}
+
+	attempts, err := getQuizAttempts(userID, course.Id, moduleIndex)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, quizOverview{Quiz: publicQuiz(*quiz), Summary: summarizeAttempts(*quiz, attempts)})
+}
+
+type submitQuizAttemptInput struct {
+	Answers []models.QuizAnswer `json:"answers" binding:"max=200"`
+}
+
+func SubmitQuizAttempt(c *gin.Context) {
+	userID, course, moduleIndex, quiz, ok := quizFromParams(c)
+	if !ok {
+		return
+	}
+
+	var submission submitQuizAttemptInput
+	if !bindJSON(c, &submission) {
+		return
+	}
+
+	if len(submission.Answers) != len(quiz.Questions) {
+		apperror.Respond(c, apperror.Validation("answer_count_mismatch", fmt.Sprintf("Expected %d answers, got %d", len(quiz.Questions), len(submission.Answers))))
+		return
+	}
+
+	var attempts []models.QuizAttempt
+	var attempt models.QuizAttempt
+	for {
+		var err error
+		attempts, err = getQuizAttempts(userID, course.Id, moduleIndex)
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+
+		if quiz.MaxAttempts > 0 && len(attempts) >= quiz.MaxAttempts {
+			apperror.Respond(c, apperror.Forbidden("max_attempts_reached", "Maximum number of attempts reached"))
+			return
+		}
+
+		attempt, err = submitQuizAttempt(userID, course.Id, moduleIndex, len(attempts)+1, *quiz, submission.Answers)
+		if mongo.IsDuplicateKeyError(err) {
+			// A concurrent submission took this attempt number; count
+			// again so it is held against the limit.
+			continue
+		}
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		break
+	}
+
+	var certificate *models.Certificate
+	if attempt.Passed {
+		status, err := getCourseStatus(userID, course)
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		certificate, err = issueCertificateIfCompleted(userID, course, status)
+		if err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+	}
+
+	attempts = append([]models.QuizAttempt{attempt}, attempts...)
+	c.JSON(http.StatusOK, quizResult{
+		Score:       attempt.Score,
+		Passed:      attempt.Passed,
+		Summary:     summarizeAttempts(*quiz, attempts),
+		Certificate: issuedCertificate(certificate),
+	})
+}
+
+type quizAttemptResponse struct {
+	Id      primitive.ObjectID  `json:"_id"`
+	Date    primitive.DateTime  `json:"date"`
+	Number  int                 `json:"number,omitempty"`
+	Answers []models.QuizAnswer `json:"answers"`
+	Score   int                 `json:"score"`
+	Passed  bool                `json:"passed"`
+}
+
+func quizAttemptResponseOf(attempt models.QuizAttempt) quizAttemptResponse {
+	return quizAttemptResponse{
+		Id:      attempt.Id,
+		Date:    attempt.Date,
+		Number:  attempt.Number,
+		Answers: attempt.Answers,
+		Score:   attempt.Score,
+		Passed:  attempt.Passed,
+	}
+}
+
+func GetQuizAttempts(c *gin.Context) {
+	userID, course, moduleIndex, _, ok := quizFromParams(c)
+	if !ok {
+		return
+	}
+
+	attempts, err := getQuizAttempts(userID, course.Id, moduleIndex)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	// The stored answers are the learner's own, so returning them is safe;
+	// the expected answers are never part of an attempt.
+	c.JSON(http.StatusOK, responsesOf(attempts, quizAttemptResponseOf))
+}
+
+// quizFromParams resolves the authenticated user and the quiz addressed by
+// the ":id" and ":module" route parameters, checking that the user may
+// access that module.
+func quizFromParams(c *gin.Context) (primitive.ObjectID, *models.Course, int, *models.Quiz, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return primitive.NilObjectID, nil, 0, nil, false
+	}
+
+	course, ok := courseFromParam(c)
+	if !ok {
+		return primitive.NilObjectID, nil, 0, nil, false
+	}
+
+	moduleIndex, ok := moduleIndexFromParam(c, course)
+	if !ok {
+		return primitive.NilObjectID, nil, 0, nil, false
+	}
+
+	quiz := course.Modules[moduleIndex].Quiz
+	if quiz == nil || len(quiz.Questions) == 0 {
+		apperror.Respond(c, apperror.NotFound("module_has_no_quiz", "Module has no quiz"))
+		return primitive.NilObjectID, nil, 0, nil, false
+	}
+
+	if !requireModuleAccess(c, userID.(primitive.ObjectID), course, moduleIndex) {
+		return primitive.NilObjectID, nil, 0, nil, false
+	}
+
+	return userID.(primitive.ObjectID), course, moduleIndex, quiz, true
+}
+
+func isEnrolled(userID, courseID primitive.ObjectID) (bool, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	count, err := collection.CountDocuments(context.Background(), bson.M{"_id": userID, "cursos": courseID})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// submitQuizAttempt grades and stores the user's attempt with the given
+// number. Attempt numbers are unique per quiz and user, so of two concurrent
+// submissions for the same number one fails with a duplicate key error.
+func submitQuizAttempt(userID, courseID primitive.ObjectID, moduleIndex, number int, quiz models.Quiz, answers []models.QuizAnswer) (models.QuizAttempt, error) {
+	score := gradeQuiz(quiz, answers)
+	attempt := models.QuizAttempt{
+		Id:       primitive.NewObjectID(),
+		Date:     primitive.NewDateTimeFromTime(time.Now()),
+		UserID:   userID,
+		CourseID: courseID,
+		Module:   moduleIndex,
+		Number:   number,
+		Answers:  answers,
+		Score:    score,
+		Passed:   score >= quiz.PassingScore,
+	}
+
+	_, err := db.InsertOne(db.Instance.Client, context.Background(), db.Instance.Dbname, db.QuizAttemptCollection, attempt)
+	return attempt, err
+}
+
+// getQuizAttempts returns the user's attempts for one quiz, newest first.
+func getQuizAttempts(userID, courseID primitive.ObjectID, moduleIndex int) ([]models.QuizAttempt, error) {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.QuizAttemptCollection)
+	filter := bson.M{"user_id": userID, "course_id": courseID, "module": moduleIndex}
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	attempts := []models.QuizAttempt{}
+	if err = cursor.All(context.Background(), &attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// summarizeAttempts applies the quiz score policy to attempts, which must be
+// ordered newest first.
+func summarizeAttempts(quiz models.Quiz, attempts []models.QuizAttempt) quizSummary {
+	summary := quizSummary{AttemptsUsed: len(attempts)}
+
+	if quiz.MaxAttempts > 0 {
+		remaining := quiz.MaxAttempts - len(attempts)
+		if remaining < 0 {
+			remaining = 0
+		}
+		summary.AttemptsRemaining = &remaining
+	}
+
+	if len(attempts) == 0 {
+		return summary
+	}
+
+	kept := attempts[0]
+	if quiz.ScorePolicy != models.ScorePolicyLast {
+		for _, attempt := range attempts[1:] {
+			if attempt.Score > kept.Score {
+				kept = attempt
+			}
+		}
+	}
+	summary.KeptScore = &kept.Score
+	summary.Passed = kept.Passed
+
+	return summary
+}
+
+// gradeQuiz returns the percentage of points earned, from 0 to 100.
+func gradeQuiz(quiz models.Quiz, answers []models.QuizAnswer) int {
+	total, earned := 0, 0
+	for i, question := range quiz.Questions {
+		points := questionPoints(question)
+		total += points
+		if i < len(answers) && isCorrect(question, answers[i]) {
+			earned += points
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+	return earned * 100 / total
+}
+
+func questionPoints(question models.Question) int {
+	if question.Points <= 0 {
+		return 1
+	}
+	return question.Points
+}
+
+func isCorrect(question models.Question, answer models.QuizAnswer) bool {
+	switch question.Type {
+	case models.QuestionMultipleChoice:
+		return len(answer.Options) == 1 && len(question.CorrectOptions) == 1 && answer.Options[0] == question.CorrectOptions[0]
+	case models.QuestionMultiSelect:
+		return sameOptions(answer.Options, question.CorrectOptions)
+	case models.QuestionTrueFalse:
+		return answer.Bool != nil && question.CorrectBool != nil && *answer.Bool == *question.CorrectBool
+	case models.QuestionShortAnswer:
+		given := normalizeShortAnswer(answer.Text)
+		for _, accepted := range question.AcceptedAnswers {
+			if given != "" && given == normalizeShortAnswer(accepted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOptions(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]int(nil), a...)
+	b = append([]int(nil), b...)
+	sort.Ints(a)
+	sort.Ints(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeShortAnswer(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// publicQuiz returns a copy of quiz with every expected answer removed so it
+// can be sent to learners.
+func publicQuiz(quiz models.Quiz) models.Quiz {
+	questions := make([]models.Question, len(quiz.Questions))
+	for i, question := range quiz.Questions {
+		questions[i] = models.Question{
+			Type:    question.Type,
+			Prompt:  question.Prompt,
+			Options: question.Options,
+			Points:  questionPoints(question),
+		}
+	}
+	quiz.Questions = questions
+	return quiz
+}
+
+// hideQuizAnswers strips expected answers from every quiz in the courses,
+// except on courses created by viewerID, who needs them to edit the quiz.
+func hideQuizAnswers(courses []models.Course, viewerID primitive.ObjectID) {
+	for i := range courses {
+		if !viewerID.IsZero() && courses[i].CreatorID == viewerID {
+			continue
+		}
+		modules := make([]models.Module, len(courses[i].Modules))
+		for j, module := range courses[i].Modules {
+			if module.Quiz != nil {
+				quiz := publicQuiz(*module.Quiz)
+				module.Quiz = &quiz
+			}
+			modules[j] = module
+		}
+		courses[i].Modules = modules
+	}
+}
+
+func validateModules(modules []models.Module) error {
+	for i, module := range modules {
+		for j, assignment := range module.Assignments {
+			if err := validateAssignment(assignment); err != nil {
+				return fmt.Errorf("module %d: assignment %d: %w", i, j, err)
+			}
+		}
+		if module.Quiz == nil {
+			continue
+		}
+		if err := validateQuiz(*module.Quiz); err != nil {
+			return fmt.Errorf("module %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateQuiz(quiz models.Quiz) error {
+	if quiz.PassingScore < 0 || quiz.PassingScore > 100 {
+		return errors.New("passing_score must be between 0 and 100")
+	}
+	if quiz.MaxAttempts < 0 {
+		return errors.New("max_attempts cannot be negative")
+	}
+	if quiz.ScorePolicy != "" && quiz.ScorePolicy != models.ScorePolicyBest && quiz.ScorePolicy != models.ScorePolicyLast {
+		return errors.New("score_policy must be 'best' or 'last'")
+	}
+
+	for i, question := range quiz.Questions {
+		if err := validateQuestion(question); err != nil {
+			return fmt.Errorf("question %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateQuestion(question models.Question) error {
+	switch question.Type {
+	case models.QuestionMultipleChoice, models.QuestionMultiSelect:
+		if len(question.Options) < 2 {
+			return errors.New("at least two options are required")
+		}
+		if len(question.CorrectOptions) == 0 {
+			return errors.New("correct_options is required")
+		}
+		if question.Type == models.QuestionMultipleChoice && len(question.CorrectOptions) != 1 {
+			return errors.New("multiple choice questions have exactly one correct option")
+		}
+		for _, option := range question.CorrectOptions {
+			if option < 0 || option >= len(question.Options) {
+				return fmt.Errorf("correct option %d is out of range", option)
+			}
+		}
+	case models.QuestionTrueFalse:
+		if question.CorrectBool == nil {
+			return errors.New("correct_bool is required")
+		}
+	case models.QuestionShortAnswer:
+		if len(question.AcceptedAnswers) == 0 {
+			return errors.New("accepted_answers is required")
+		}
+	default:
+		return fmt.Errorf("unknown question type %q", question.Type)
+	}
+	return nil
+}
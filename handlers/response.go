@@ -0,0 +1,14 @@
+package handlers
+
+// Handlers answer with response types declared next to them, like
+// courseResponse, rather than with the models they store. A field added to
+// a model stays on the server until it is added to its response type.
+
+// responsesOf maps every item to its response type.
+func responsesOf[T, R any](items []T, of func(T) R) []R {
+	responses := make([]R, len(items))
+	for i, item := range items {
+		responses[i] = of(item)
+	}
+	return responses
+}
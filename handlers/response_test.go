@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testPasswordHash = "$2a$14$abcdefghijklmnopqrstuv0123456789ABCDEFGHIJKLMNOPQRSTU"
+
+// secretFields may never appear in a response body.
+var secretFields = []string{"password", "hash", "totp_secret", "recovery_codes", "password_reset_token", "email_change_token"}
+
+// serverFields are decided by the server and may never be set by a request.
+var serverFields = []string{"_id", "date", "creator_id", "ratings", "archived", "cursos", "admin", "members", "waitlist", "user_id"}
+
+func secretUser() models.User {
+	return models.User{
+		Id:                 primitive.NewObjectID(),
+		Email:              "ada@example.com",
+		Password:           testPasswordHash,
+		TOTPSecret:         "JBSWY3DPEHPK3PXP",
+		RecoveryCodes:      []string{"recovery-code-hash"},
+		PasswordResetToken: "reset-token-hash",
+		EmailChangeToken:   "email-token-hash",
+	}
+}
+
+func assertNoSecrets(t *testing.T, name string, value interface{}) {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	body := string(data)
+	if strings.Contains(strings.ToLower(body), "password") {
+		t.Errorf("%s contains a password field: %s", name, body)
+	}
+	for _, secret := range []string{testPasswordHash, "JBSWY3DPEHPK3PXP", "recovery-code-hash", "reset-token-hash", "email-token-hash"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("%s leaks %q: %s", name, secret, body)
+		}
+	}
+}
+
+func TestUserResponsesNeverContainPassword(t *testing.T) {
+	user := secretUser()
+	assertNoSecrets(t, "models.User", user)
+	assertNoSecrets(t, "userResponse", userResponseOf(user))
+	assertNoSecrets(t, "profile", profileOf(&user))
+	assertNoSecrets(t, "[]models.User", []models.User{user})
+}
+
+// jsonFields lists the JSON names of every field value of type t can
+// contain, following nested structs, pointers, slices and maps.
+func jsonFields(t reflect.Type, seen map[reflect.Type]bool) []string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, strings.ToLower(name))
+		names = append(names, jsonFields(field.Type, seen)...)
+	}
+	return names
+}
+
+func TestResponseTypesHaveNoSecretFields(t *testing.T) {
+	responses := []interface{}{
+		userResponse{}, profile{}, LoginResponse{}, rosterEntry{}, exportedRating{},
+		instructorProfile{}, certificateVerification{}, cohortRoster{}, quizResult{}, threadWithPosts{}, createdAPIKey{},
+		courseResponse{}, cohortSummary{}, sessionResponse{}, apiKeyResponse{}, securityEventResponse{},
+		submissionResponse{}, certificateResponse{}, threadResponse{}, postResponse{}, noteResponse{},
+		bookmarkResponse{}, pathResponse{}, quizAttemptResponse{},
+	}
+	for _, response := range responses {
+		typ := reflect.TypeOf(response)
+		for _, name := range jsonFields(typ, map[reflect.Type]bool{}) {
+			for _, secret := range secretFields {
+				if name == secret {
+					t.Errorf("%s serializes the secret field %q", typ, name)
+				}
+			}
+		}
+	}
+}
+
+func TestRequestTypesCannotSetServerFields(t *testing.T) {
+	requests := []interface{}{
+		registerInput{}, courseInput{}, ratingInput{}, cohortInput{}, pathInput{}, profileInput{}, noteInput{},
+	}
+	for _, request := range requests {
+		typ := reflect.TypeOf(request)
+		// Modules are course content and carry their own assignment IDs,
+		// which assignAssignmentIDs fills in; only look at the top level.
+		for i := 0; i < typ.NumField(); i++ {
+			name := strings.SplitN(typ.Field(i).Tag.Get("json"), ",", 2)[0]
+			for _, server := range serverFields {
+				if name == server {
+					t.Errorf("%s lets clients set %q", typ, name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	eventSessionRevoked       = "session_revoked"
+	eventOtherSessionsRevoked = "other_sessions_revoked"
+)
+
+type sessionResponse struct {
+	Id        primitive.ObjectID `json:"_id"`
+	Date      primitive.DateTime `json:"date"`
+	IP        string             `json:"ip"`
+	UserAgent string             `json:"user_agent"`
+	LastSeen  primitive.DateTime `json:"last_seen"`
+	ExpiresAt primitive.DateTime `json:"expires_at"`
+	Current   bool               `json:"current"`
+}
+
+func sessionResponseOf(session models.Session) sessionResponse {
+	return sessionResponse{
+		Id:        session.Id,
+		Date:      session.Date,
+		IP:        session.IP,
+		UserAgent: session.UserAgent,
+		LastSeen:  session.LastSeen,
+		ExpiresAt: session.ExpiresAt,
+	}
+}
+
+// GetSessions lists where the user is logged in, most recently used first.
+func GetSessions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SessionCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "last_seen", Value: -1}})
+	cursor, err := collection.Find(context.Background(), activeSessionsFilter(userID.(primitive.ObjectID)), opts)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	sessions := []models.Session{}
+	if err = cursor.All(context.Background(), &sessions); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	current, _ := c.Get("sessionID")
+	responses := responsesOf(sessions, sessionResponseOf)
+	for i := range responses {
+		responses[i].Current = responses[i].Id == current
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// RevokeSession logs the user out of one session, which may be the
+// current one.
+func RevokeSession(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		apperror.Respond(c, apperror.Validation("invalid_session_id", "Invalid session ID"))
+		return
+	}
+
+	filter := activeSessionsFilter(userID.(primitive.ObjectID))
+	filter["_id"] = sessionID
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SessionCollection)
+	count, err := collection.CountDocuments(context.Background(), filter)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if count == 0 {
+		apperror.Respond(c, apperror.NotFound("session_not_found", "Session not found"))
+		return
+	}
+
+	if err := revokeSessions(filter); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, userID.(primitive.ObjectID), eventSessionRevoked)
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions logs the user out everywhere but here.
+func RevokeOtherSessions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		apperror.Respond(c, apperror.Unauthorized("unauthorized", "Unauthorized"))
+		return
+	}
+
+	if err := revokeOtherSessions(c, userID.(primitive.ObjectID)); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, userID.(primitive.ObjectID), eventOtherSessionsRevoked)
+	c.JSON(http.StatusOK, gin.H{"message": "Other sessions revoked"})
+}
+
+// revokeOtherSessions revokes every session of the user except the one the
+// request was made with, so the caller stays logged in.
+func revokeOtherSessions(c *gin.Context, userID primitive.ObjectID) error {
+	filter := bson.M{"user_id": userID}
+	if current, ok := c.Get("sessionID"); ok {
+		filter["_id"] = bson.M{"$ne": current}
+	}
+	return revokeSessions(filter)
+}
+
+// revokeSessions revokes the sessions matching filter and drops them from
+// the auth cache so the revocation takes effect on the next request.
+func revokeSessions(filter bson.M) error {
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.SessionCollection)
+
+	filter["revoked_at"] = bson.M{"$exists": false}
+	cursor, err := collection.Find(context.Background(), filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var revoked []models.Session
+	if err = cursor.All(context.Background(), &revoked); err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(revoked))
+	for _, session := range revoked {
+		ids = append(ids, session.Id)
+	}
+	now := primitive.NewDateTimeFromTime(time.Now())
+	if _, err := collection.UpdateMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"revoked_at": now}}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		auth.InvalidateSession(id)
+	}
+	return nil
+}
+
+func activeSessionsFilter(userID primitive.ObjectID) bson.M {
+	return bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+	}
+}
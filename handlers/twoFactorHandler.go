@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/db"
+	models "github.com/phcarneirobc/free-learn/model"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	totpIssuer        = "FreeLearn"
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+const (
+	eventTwoFactorEnabled         = "two_factor_enabled"
+	eventTwoFactorDisabled        = "two_factor_disabled"
+	eventRecoveryCodesRegenerated = "recovery_codes_regenerated"
+	eventRecoveryCodeUsed         = "recovery_code_used"
+)
+
+// twoFactorSetup is the pending secret, both raw for manual entry and as an
+// otpauth:// URI for QR codes.
+type twoFactorSetup struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type recoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type setupTwoFactorInput struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// SetupTwoFactor creates a new TOTP secret for the user. It is only stored
+// as pending until ConfirmTwoFactor proves the authenticator app has it.
+func SetupTwoFactor(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input setupTwoFactorInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !checkCurrentPassword(c, user, input.Password, "Password is incorrect") {
+		return
+	}
+
+	if user.TOTPEnabled {
+		apperror.Respond(c, apperror.Conflict("two_factor_already_enabled", "Two-factor authentication is already enabled"))
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Email})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := updateUserByID(user.Id, bson.M{
+		"$set":   bson.M{"totp_secret": key.Secret()},
+		"$unset": bson.M{"totp_last_step": ""},
+	}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, twoFactorSetup{Secret: key.Secret(), OTPAuthURI: key.URL()})
+}
+
+type confirmTwoFactorInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ConfirmTwoFactor enables 2FA once the user enters a code generated from
+// the pending secret, and hands out the recovery codes. They are shown
+// only this once.
+func ConfirmTwoFactor(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input confirmTwoFactorInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if user.TOTPEnabled {
+		apperror.Respond(c, apperror.Conflict("two_factor_already_enabled", "Two-factor authentication is already enabled"))
+		return
+	}
+	if user.TOTPSecret == "" {
+		apperror.Respond(c, apperror.Validation("two_factor_setup_not_started", "Two-factor setup has not been started"))
+		return
+	}
+	if !checkTOTPCode(c, user, input.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := updateUserByID(user.Id, bson.M{"$set": bson.M{"totp_enabled": true, "recovery_codes": hashes}}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := revokeOtherSessions(c, user.Id); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventTwoFactorEnabled)
+	c.JSON(http.StatusOK, recoveryCodes{RecoveryCodes: codes})
+}
+
+type disableTwoFactorInput struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+func DisableTwoFactor(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input disableTwoFactorInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		apperror.Respond(c, apperror.Validation("two_factor_not_enabled", "Two-factor authentication is not enabled"))
+		return
+	}
+	if !checkCurrentPassword(c, user, input.Password, "Password is incorrect") {
+		return
+	}
+
+	valid, err := checkSecondFactor(c, user, input.Code)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if !valid {
+		if err := recordFailedLogin(user.Email, c.ClientIP()); err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		apperror.Respond(c, apperror.Unauthorized("invalid_code", "Invalid code"))
+		return
+	}
+
+	err = updateUserByID(user.Id, bson.M{
+		"$set":   bson.M{"totp_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	})
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventTwoFactorDisabled)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+type regenerateRecoveryCodesInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// RegenerateRecoveryCodes replaces every remaining recovery code.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var input regenerateRecoveryCodesInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		apperror.Respond(c, apperror.Validation("two_factor_not_enabled", "Two-factor authentication is not enabled"))
+		return
+	}
+	if !checkTOTPCode(c, user, input.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	if err := updateUserByID(user.Id, bson.M{"$set": bson.M{"recovery_codes": hashes}}); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	recordSecurityEvent(c, user.Id, eventRecoveryCodesRegenerated)
+	c.JSON(http.StatusOK, recoveryCodes{RecoveryCodes: codes})
+}
+
+type loginTwoFactorInput struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// LoginTwoFactor is the second step of a login for accounts with 2FA. It
+// exchanges the challenge token from Login and a TOTP or recovery code for
+// a session token.
+func LoginTwoFactor(c *gin.Context) {
+	var input loginTwoFactorInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	userID, err := auth.ValidateChallengeToken(input.ChallengeToken)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		apperror.Respond(c, err)
+		return
+	}
+	if user == nil || !user.TOTPEnabled {
+		apperror.Respond(c, apperror.Unauthorized("invalid_challenge_token", "Invalid or expired challenge token"))
+		return
+	}
+
+	if err := checkLoginLockout(accountAttemptKey(user.Email), ipAttemptKey(c.ClientIP())); err != nil {
+		respondLoginError(c, err)
+		return
+	}
+
+	valid, err := checkSecondFactor(c, user, input.Code)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if !valid {
+		if err := recordFailedLogin(user.Email, c.ClientIP()); err != nil {
+			apperror.Respond(c, err)
+			return
+		}
+		apperror.Respond(c, apperror.Unauthorized("invalid_code", "Invalid code"))
+		return
+	}
+
+	if err := clearLoginFailures(user.Email); err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+
+	response, err := sessionLoginResponse(c, *user)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, loginResult{Token: response})
+}
+
+// checkTOTPCode checks a code from the authenticator app of a signed-in
+// user, writing the error response itself when it is wrong. Like
+// checkCurrentPassword, wrong codes count against the login lockout so a
+// stolen session cannot be used to guess them.
+func checkTOTPCode(c *gin.Context, user *models.User, code string) bool {
+	if err := checkLoginLockout(accountAttemptKey(user.Email), ipAttemptKey(c.ClientIP())); err != nil {
+		respondLoginError(c, err)
+		return false
+	}
+
+	valid, err := acceptTOTPCode(user, code)
+	if err != nil {
+		apperror.Respond(c, err)
+		return false
+	}
+	if !valid {
+		if err := recordFailedLogin(user.Email, c.ClientIP()); err != nil {
+			apperror.Respond(c, err)
+			return false
+		}
+		apperror.Respond(c, apperror.Unauthorized("invalid_code", "Invalid code"))
+		return false
+	}
+	return true
+}
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// recovery codes, each only once. A recovery code is removed in the same
+// update that checks it.
+func checkSecondFactor(c *gin.Context, user *models.User, code string) (bool, error) {
+	valid, err := acceptTOTPCode(user, code)
+	if err != nil || valid {
+		return valid, err
+	}
+
+	hash := auth.HashOpaqueToken(normalizeRecoveryCode(strings.TrimSpace(code)))
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	result, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": user.Id, "recovery_codes": hash},
+		bson.M{"$pull": bson.M{"recovery_codes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if result.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	recordSecurityEvent(c, user.Id, eventRecoveryCodeUsed)
+	return true, nil
+}
+
+// acceptTOTPCode accepts a code for the current time step or the one on
+// either side, as totp.Validate does, but only once: the step of an
+// accepted code is stored in the same update that checks it, and no code
+// for that step or an earlier one is accepted again.
+func acceptTOTPCode(user *models.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	opts := hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	current := time.Now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if valid, err := hotp.ValidateCustom(code, uint64(step), user.TOTPSecret, opts); err != nil || !valid {
+			continue
+		}
+
+		collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+		result, err := collection.UpdateOne(context.Background(),
+			bson.M{"_id": user.Id, "$or": []bson.M{
+				{"totp_last_step": bson.M{"$exists": false}},
+				{"totp_last_step": bson.M{"$lt": step}},
+			}},
+			bson.M{"$set": bson.M{"totp_last_step": step}},
+		)
+		if err != nil {
+			return false, err
+		}
+		return result.ModifiedCount == 1, nil
+	}
+	return false, nil
+}
+
+// newRecoveryCodes returns the codes to show the user and the hashes to
+// store in their place.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		codes = append(codes, encoded[:4]+"-"+encoded[4:])
+		hashes = append(hashes, auth.HashOpaqueToken(encoded))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
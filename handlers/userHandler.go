@@ -2,13 +2,13 @@ package handlers
 
 import (
 	"context"
-	"errors"
 	"strings"
 	"time"
 
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
 	"github.com/phcarneirobc/free-learn/auth"
 	"github.com/phcarneirobc/free-learn/db"
 	models "github.com/phcarneirobc/free-learn/model"
@@ -17,27 +17,48 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var errEmailTaken = apperror.Conflict("email_taken", "A user with this email already exists")
+
+type registerInput struct {
+	Email     string `json:"email" binding:"required,email,max=254"`
+	Password  string `json:"password" binding:"required,password"`
+	Professor bool   `json:"professor"`
+}
+
+// userResponse is the account as its owner sees it after registering.
+// Responses never embed models.User, so fields added to it stay private
+// until they are added here.
+type userResponse struct {
+	Id        primitive.ObjectID `json:"_id"`
+	Email     string             `json:"email"`
+	Professor bool               `json:"professor"`
+	Date      primitive.DateTime `json:"date"`
+}
+
+func userResponseOf(user models.User) userResponse {
+	return userResponse{Id: user.Id, Email: user.Email, Professor: user.Professor, Date: user.Date}
+}
+
 func Register(c *gin.Context) {
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var input registerInput
+	if !bindJSON(c, &input) {
 		return
 	}
-	result, err := registerUser(user)
+	user, err := registerUser(input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, userResponseOf(*user))
 }
 
-func registerUser(user models.User) (*mongo.InsertOneResult, error) {
+func registerUser(user registerInput) (*models.User, error) {
 	existingUser, err := getUserByEmail(user.Email)
 	if err != nil {
 		return nil, err
 	}
 	if existingUser != nil {
-		return nil, errors.New("user with this email already exists")
+		return nil, errEmailTaken
 	}
 
 	hashedPassword, err := auth.HashPassword(user.Password)
@@ -52,15 +73,16 @@ func registerUser(user models.User) (*mongo.InsertOneResult, error) {
 		Professor: user.Professor,
 		Date:      primitive.NewDateTimeFromTime(time.Now()),
 		Cursos:    []primitive.ObjectID{},
+		Paths:     []primitive.ObjectID{},
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	result, err := db.InsertOne(db.Instance.Client, ctx, db.Instance.Dbname, db.UserCollection, userToInsert)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.InsertOne(db.Instance.Client, ctx, db.Instance.Dbname, db.UserCollection, userToInsert); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return &userToInsert, nil
 }
 
 func getUserByEmail(email string) (*models.User, error) {
@@ -77,80 +99,170 @@ func getUserByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
+func getUserByID(id primitive.ObjectID) (*models.User, error) {
+	var user models.User
+	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LoginResponse carries either the session Token or, for accounts with
+// two-factor authentication, a ChallengeToken to exchange at /login/2fa.
 type LoginResponse struct {
-	ID        primitive.ObjectID
-	Token     string
-	Professor bool
+	ID                     primitive.ObjectID
+	Token                  string
+	Professor              bool
+	TwoFactorRequired      bool
+	ChallengeToken         string `json:",omitempty"`
+	TwoFactorSetupRequired bool   `json:",omitempty"`
+}
+
+type loginResult struct {
+	Token LoginResponse `json:"token"`
+}
+
+type loginInput struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
 }
 
 func Login(c *gin.Context) {
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var input loginInput
+	if !bindJSON(c, &input) {
 		return
 	}
-	token, err := loginUser(user)
+	token, err := loginUser(c, models.User{Email: input.Email, Password: input.Password})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondLoginError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	c.JSON(http.StatusOK, loginResult{Token: token})
 }
 
-func loginUser(user models.User) (LoginResponse, error) {
+// loginUser answers an unknown email exactly like a wrong password, down to
+// the time spent hashing, so it cannot be used to find registered accounts.
+func loginUser(c *gin.Context, user models.User) (LoginResponse, error) {
 	collection := db.Instance.Client.Database(db.Instance.Dbname).Collection(db.UserCollection)
+	ip := c.ClientIP()
 
 	email := strings.ToLower(user.Email)
+	if err := checkLoginLockout(accountAttemptKey(email), ipAttemptKey(ip)); err != nil {
+		return LoginResponse{}, err
+	}
+
 	var result models.User
 	err := collection.FindOne(context.Background(), bson.M{"email": email}).Decode(&result)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return LoginResponse{}, errors.New("email not found")
+		if err != mongo.ErrNoDocuments {
+			return LoginResponse{}, err
 		}
-		return LoginResponse{}, err
+		compareDummyPassword(user.Password)
+		if err := recordFailedLogin(email, ip); err != nil {
+			return LoginResponse{}, err
+		}
+		return LoginResponse{}, errInvalidCredentials
 	}
 
 	match := auth.CheckPasswordHash(user.Password, result.Password)
 	if !match {
-		return LoginResponse{}, errors.New("invalid password")
+		if err := recordFailedLogin(email, ip); err != nil {
+			return LoginResponse{}, err
+		}
+		return LoginResponse{}, errInvalidCredentials
+	}
+
+	return completeLogin(c, result)
+}
+
+// completeLogin finishes a login whose first factor has been verified,
+// asking for the second one if the account has 2FA enabled.
+func completeLogin(c *gin.Context, result models.User) (LoginResponse, error) {
+	if result.TOTPEnabled {
+		challenge, err := auth.GenerateChallengeToken(result)
+		if err != nil {
+			return LoginResponse{}, err
+		}
+		return LoginResponse{
+			ID:                result.Id,
+			Professor:         result.Professor,
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+		}, nil
+	}
+
+	if err := clearLoginFailures(result.Email); err != nil {
+		return LoginResponse{}, err
 	}
+	return sessionLoginResponse(c, result)
+}
 
-	token, err := auth.GenerateToken(result)
+func sessionLoginResponse(c *gin.Context, user models.User) (LoginResponse, error) {
+	token, err := auth.NewSession(c, user)
 	if err != nil {
 		return LoginResponse{}, err
 	}
 	return LoginResponse{
-		ID:        result.Id,
-		Token:     token,
-		Professor: result.Professor,
+		ID:                     user.Id,
+		Token:                  token,
+		Professor:              user.Professor,
+		TwoFactorSetupRequired: auth.TwoFactorRequired(user) && !user.TOTPEnabled,
 	}, nil
 }
 
+type addCourseToUserInput struct {
+	CourseID string `json:"course_id" binding:"required"`
+}
+
 func AddCourseToUser(c *gin.Context) {
 	userID := c.Param("id")
 
 	userIDObj, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		apperror.Respond(c, apperror.Validation("invalid_user_id", "Invalid user ID"))
 		return
 	}
 
-	var courseID struct {
-		CourseID string `json:"course_id"`
-	}
-	if err := c.ShouldBindJSON(&courseID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+	var courseID addCourseToUserInput
+	if !bindJSON(c, &courseID) {
 		return
 	}
 
 	courseIDObj, err := primitive.ObjectIDFromHex(courseID.CourseID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+		apperror.Respond(c, apperror.Validation("invalid_course_id", "Invalid course ID"))
+		return
+	}
+
+	course, err := getCourseByID(courseIDObj)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			apperror.Respond(c, apperror.NotFound("course_not_found", "Course not found"))
+			return
+		}
+		apperror.Respond(c, err)
+		return
+	}
+
+	if course.Archived {
+		apperror.Respond(c, apperror.Forbidden("course_archived", "Course is archived and no longer accepts enrollments"))
+		return
+	}
+
+	missing, err := missingPrerequisites(userIDObj, course)
+	if err != nil {
+		apperror.Respond(c, err)
+		return
+	}
+	if len(missing) > 0 {
+		apperror.Respond(c, errPrerequisitesMissing(missing))
 		return
 	}
 
 	if err := addCourseToUser(userIDObj, courseIDObj); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apperror.Respond(c, err)
 		return
 	}
 
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/phcarneirobc/free-learn/apperror"
+)
+
+// Request bodies are validated with `binding` struct tags. Besides the
+// validator's built-in rules, "password" checks the password policy.
+// Passwords longer than 72 bytes are refused since bcrypt ignores the rest.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// fieldError is one entry of the errors member of a validation problem.
+// Field is the JSON path of the offending value, like "modules[0].name",
+// and Rule the tag that failed.
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var registerValidatorsOnce sync.Once
+
+func registerValidators() {
+	engine, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	engine.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	engine.RegisterValidation("password", func(fl validator.FieldLevel) bool {
+		return validPassword(fl.Field().String())
+	})
+}
+
+// validPassword requires minPasswordLength to maxPasswordLength bytes with
+// at least one letter and one digit.
+func validPassword(password string) bool {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return false
+	}
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	return letter && digit
+}
+
+// bindJSON decodes and validates the request body into obj. When the body
+// is invalid it writes a problem listing every failed field and returns
+// false.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	registerValidatorsOnce.Do(registerValidators)
+
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	apperror.Respond(c, validationProblem(err))
+	return false
+}
+
+// validate checks the binding tags of obj, for values that were not read
+// by bindJSON, like the result of applying a patch.
+func validate(obj interface{}) error {
+	registerValidatorsOnce.Do(registerValidators)
+
+	if err := binding.Validator.ValidateStruct(obj); err != nil {
+		return validationProblem(err)
+	}
+	return nil
+}
+
+// validationProblem lists every failed field of a validator error; other
+// errors mean the body could not be decoded.
+func validationProblem(err error) *apperror.Error {
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return apperror.Validation("invalid_body", err.Error())
+	}
+
+	fields := make([]fieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		fields = append(fields, fieldError{
+			Field:   fieldPath(fe.Namespace()),
+			Rule:    fe.Tag(),
+			Message: fieldMessage(fe),
+		})
+	}
+	return apperror.Validation("invalid_fields", "The request has invalid fields").With("errors", fields)
+}
+
+// fieldPath drops the struct name the validator puts in front of the
+// namespace, leaving the JSON path.
+func fieldPath(namespace string) string {
+	if i := strings.IndexByte(namespace, '.'); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	countable := fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map || fe.Kind() == reflect.Array
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "http_url":
+		return "must be an http or https URL"
+	case "password":
+		return fmt.Sprintf("must be %d to %d characters long and contain a letter and a digit", minPasswordLength, maxPasswordLength)
+	case "oneof":
+		return "must be one of: " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "min":
+		if countable {
+			return fmt.Sprintf("must contain at least %s items", fe.Param())
+		}
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at least %s characters long", fe.Param())
+		}
+		return "must be at least " + fe.Param()
+	case "max":
+		if countable {
+			return fmt.Sprintf("must contain at most %s items", fe.Param())
+		}
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters long", fe.Param())
+		}
+		return "must be at most " + fe.Param()
+	}
+	return "is invalid"
+}
+
+// invalidField reports a single invalid field in the same shape as
+// bindJSON, for rules that need more than struct tags, like looking up
+// referenced documents.
+func invalidField(field, rule, message string) *apperror.Error {
+	return apperror.Validation("invalid_fields", "The request has invalid fields").
+		With("errors", []fieldError{{Field: field, Rule: rule, Message: message}})
+}
@@ -0,0 +1,212 @@
+// Package identity signs users in with external OpenID Connect providers
+// using the authorization code flow with PKCE.
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// ProviderConfig describes one OpenID Connect provider.
+type ProviderConfig struct {
+	Name         string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Identity is what a provider asserted about the user in a verified ID
+// token.
+type Identity struct {
+	Provider      string
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// AuthRequest holds the values that must be kept between sending the user
+// to the provider and handling the callback.
+type AuthRequest struct {
+	URL      string
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// Provider is a configured provider whose discovery document has been
+// fetched.
+type Provider struct {
+	name     string
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Registry discovers providers on first use, so the API can start while a
+// provider is unreachable.
+type Registry struct {
+	mu        sync.Mutex
+	configs   map[string]ProviderConfig
+	providers map[string]*Provider
+}
+
+func NewRegistry(configs ...ProviderConfig) *Registry {
+	r := &Registry{
+		configs:   map[string]ProviderConfig{},
+		providers: map[string]*Provider{},
+	}
+	for _, config := range configs {
+		r.configs[config.Name] = config
+	}
+	return r
+}
+
+// ConfigsFromEnv reads the providers listed in OIDC_PROVIDERS, a comma
+// separated list of names. Each name is configured by OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and
+// OIDC_<NAME>_REDIRECT_URL.
+func ConfigsFromEnv() []ProviderConfig {
+	configs := []ProviderConfig{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		configs = append(configs, ProviderConfig{
+			Name:         name,
+			IssuerURL:    os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		})
+	}
+	return configs
+}
+
+// Names lists the configured providers.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.configs))
+	for name := range r.configs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Provider returns the named provider, fetching its discovery document the
+// first time. The fetch runs without holding the lock, so one slow issuer
+// does not hold up logins with the others; when two requests race to
+// discover the same provider, the first one stored wins.
+func (r *Registry) Provider(ctx context.Context, name string) (*Provider, error) {
+	r.mu.Lock()
+	provider, found := r.providers[name]
+	config, configured := r.configs[name]
+	r.mu.Unlock()
+
+	if found {
+		return provider, nil
+	}
+	if !configured {
+		return nil, ErrUnknownProvider
+	}
+
+	discovered, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", name, err)
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	provider = &Provider{
+		name: name,
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     discovered.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: discovered.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stored, ok := r.providers[name]; ok {
+		return stored, nil
+	}
+	r.providers[name] = provider
+	return provider, nil
+}
+
+// NewAuthRequest starts a login: the caller stores the request and sends
+// the user to its URL.
+func (p *Provider) NewAuthRequest() AuthRequest {
+	request := AuthRequest{
+		State:    oauth2.GenerateVerifier(),
+		Nonce:    oauth2.GenerateVerifier(),
+		Verifier: oauth2.GenerateVerifier(),
+	}
+	request.URL = p.oauth.AuthCodeURL(request.State,
+		oidc.Nonce(request.Nonce),
+		oauth2.S256ChallengeOption(request.Verifier),
+	)
+	return request
+}
+
+// Exchange redeems the authorization code from the callback and verifies
+// the ID token, including that it answers the stored request's nonce.
+func (p *Provider) Exchange(ctx context.Context, request AuthRequest, code string) (*Identity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(request.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id_token: %w", err)
+	}
+	if idToken.Nonce != request.Nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Provider:      p.name,
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
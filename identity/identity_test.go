@@ -0,0 +1,193 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// mockProvider is a minimal OpenID Connect provider: discovery, keys and a
+// token endpoint that checks the PKCE verifier against the challenge sent
+// with the authorization request.
+type mockProvider struct {
+	t         *testing.T
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/keys", m.keys)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// authorize plays the part of the user logging in at the provider.
+func (m *mockProvider) authorize(authURL string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+	m.challenge = query.Get("code_challenge")
+	m.nonce = query.Get("nonce")
+}
+
+func (m *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.server.URL,
+		"authorization_endpoint":                m.server.URL + "/authorize",
+		"token_endpoint":                        m.server.URL + "/token",
+		"jwks_uri":                              m.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockProvider) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &m.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   m.server.URL,
+		"sub":   "subject-1",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": m.nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: m.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newTestProvider(t *testing.T, m *mockProvider) *Provider {
+	registry := NewRegistry(ProviderConfig{
+		Name:         "mock",
+		IssuerURL:    m.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/oidc/callback/mock",
+	})
+	provider, err := registry.Provider(context.Background(), "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestExchange(t *testing.T) {
+	m := newMockProvider(t)
+	m.claims = map[string]interface{}{"email": "Ada@Example.com", "email_verified": true, "name": "Ada"}
+	provider := newTestProvider(t, m)
+
+	request := provider.NewAuthRequest()
+	m.authorize(request.URL)
+
+	got, err := provider.Exchange(context.Background(), request, "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{
+		Provider:      "mock",
+		Issuer:        m.server.URL,
+		Subject:       "subject-1",
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Name:          "Ada",
+	}
+	if *got != want {
+		t.Errorf("Exchange() = %+v, want %+v", *got, want)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	provider := newTestProvider(t, m)
+
+	request := provider.NewAuthRequest()
+	m.authorize(request.URL)
+	request.Verifier = provider.NewAuthRequest().Verifier
+
+	if _, err := provider.Exchange(context.Background(), request, "code"); err == nil {
+		t.Error("Exchange() with the wrong PKCE verifier succeeded")
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	m := newMockProvider(t)
+	provider := newTestProvider(t, m)
+
+	request := provider.NewAuthRequest()
+	m.authorize(request.URL)
+	request.Nonce = "replayed"
+
+	if _, err := provider.Exchange(context.Background(), request, "code"); err == nil {
+		t.Error("Exchange() with a mismatched nonce succeeded")
+	}
+}
+
+func TestUnknownProvider(t *testing.T) {
+	if _, err := NewRegistry().Provider(context.Background(), "missing"); err != ErrUnknownProvider {
+		t.Errorf("Provider() error = %v, want ErrUnknownProvider", err)
+	}
+}
@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// ErrNotConfigured is returned by Send when no SMTP server is configured.
+var ErrNotConfigured = errors.New("mail: SMTP_HOST is not set")
+
+// Send delivers a plain-text email through the SMTP server configured by
+// SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASSWORD and MAIL_FROM. Without
+// SMTP_HOST it fails with ErrNotConfigured, unless MAIL_DISCARD is "true"
+// for development, in which case the message is dropped. The body is never
+// logged since it may hold a token.
+func Send(to, subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if os.Getenv("MAIL_DISCARD") == "true" {
+			log.Printf("mail: MAIL_DISCARD set, not sending %q to %s", subject, to)
+			return nil
+		}
+		return ErrNotConfigured
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@free-learn.local"
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("mail: sending to %s: %w", to, err)
+	}
+	return nil
+}
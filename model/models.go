@@ -2,14 +2,69 @@ package models
 
 import "go.mongodb.org/mongo-driver/bson/primitive"
 
+// The binding tags of Module and Lesson are checked when a course is read
+// from a request.
+
 type Lesson struct {
-	Name string `json:"name" bson:"name"`
-	Link string `json:"link" bson:"link"`
+	Name    string `json:"name" bson:"name" binding:"required,max=200"`
+	Link    string `json:"link" bson:"link" binding:"omitempty,http_url,max=2048"`
+	Content string `json:"content" bson:"content" binding:"max=100000"`
 }
 
 type Module struct {
-	Name    string   `json:"name" bson:"name"`
-	Lessons []Lesson `json:"lessons" bson:"lessons"`
+	Name    string   `json:"name" bson:"name" binding:"required,max=200"`
+	Lessons []Lesson `json:"lessons" bson:"lessons" binding:"max=200,dive"`
+	Quiz    *Quiz    `json:"quiz,omitempty" bson:"quiz,omitempty"`
+
+	Assignments []Assignment `json:"assignments,omitempty" bson:"assignments,omitempty"`
+}
+
+const (
+	QuestionMultipleChoice = "multiple_choice"
+	QuestionMultiSelect    = "multi_select"
+	QuestionTrueFalse      = "true_false"
+	QuestionShortAnswer    = "short_answer"
+)
+
+const (
+	ScorePolicyBest = "best"
+	ScorePolicyLast = "last"
+)
+
+type Question struct {
+	Type            string   `json:"type" bson:"type"`
+	Prompt          string   `json:"prompt" bson:"prompt"`
+	Options         []string `json:"options,omitempty" bson:"options"`
+	Points          int      `json:"points" bson:"points"`
+	CorrectOptions  []int    `json:"correct_options,omitempty" bson:"correct_options"`
+	CorrectBool     *bool    `json:"correct_bool,omitempty" bson:"correct_bool"`
+	AcceptedAnswers []string `json:"accepted_answers,omitempty" bson:"accepted_answers"`
+}
+
+type Quiz struct {
+	Title        string     `json:"title" bson:"title"`
+	Questions    []Question `json:"questions" bson:"questions"`
+	PassingScore int        `json:"passing_score" bson:"passing_score"`
+	MaxAttempts  int        `json:"max_attempts" bson:"max_attempts"`
+	ScorePolicy  string     `json:"score_policy" bson:"score_policy"`
+}
+
+type QuizAnswer struct {
+	Options []int  `json:"options,omitempty" bson:"options,omitempty"`
+	Bool    *bool  `json:"bool,omitempty" bson:"bool,omitempty"`
+	Text    string `json:"text,omitempty" bson:"text,omitempty"`
+}
+
+type QuizAttempt struct {
+	Id       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date     primitive.DateTime `json:"date" bson:"date"`
+	UserID   primitive.ObjectID `json:"user_id" bson:"user_id"`
+	CourseID primitive.ObjectID `json:"course_id" bson:"course_id"`
+	Module   int                `json:"module" bson:"module"`
+	Number   int                `json:"number,omitempty" bson:"number,omitempty"`
+	Answers  []QuizAnswer       `json:"answers" bson:"answers"`
+	Score    int                `json:"score" bson:"score"`
+	Passed   bool               `json:"passed" bson:"passed"`
 }
 
 type Course struct {
@@ -22,6 +77,11 @@ type Course struct {
 	Modules     []Module           `json:"modules" bson:"modules"`
 	CreatorID   primitive.ObjectID `json:"creator_id" bson:"creator_id"`
 	Ratings     []Rating           `json:"ratings" bson:"ratings"`
+
+	Prerequisites    []primitive.ObjectID `json:"prerequisites" bson:"prerequisites"`
+	SequentialGating bool                 `json:"sequential_gating" bson:"sequential_gating"`
+
+	Archived bool `json:"archived" bson:"archived"`
 }
 
 type User struct {
@@ -29,8 +89,69 @@ type User struct {
 	Date      primitive.DateTime   `json:"date"          bson:"date"`
 	Email     string               `json:"email"         bson:"email"`
 	Professor bool                 `json:"professor"     bson:"professor"`
-	Password  string               `json:"password"      bson:"password"`
+	Admin     bool                 `json:"admin"         bson:"admin"`
+	Password  string               `json:"-"             bson:"password"`
 	Cursos    []primitive.ObjectID `json:"cursos"        bson:"cursos"`
+	Paths     []primitive.ObjectID `json:"paths"         bson:"paths"`
+
+	DisplayName string   `json:"display_name" bson:"display_name"`
+	Bio         string   `json:"bio"          bson:"bio"`
+	Avatar      string   `json:"avatar"       bson:"avatar"`
+	Links       []string `json:"links"        bson:"links"`
+	Locale      string   `json:"locale"       bson:"locale"`
+	Timezone    string   `json:"timezone"     bson:"timezone"`
+
+	PendingEmail       string             `json:"-" bson:"pending_email,omitempty"`
+	EmailChangeToken   string             `json:"-" bson:"email_change_token,omitempty"`
+	EmailChangeExpires primitive.DateTime `json:"-" bson:"email_change_expires,omitempty"`
+
+	Identities []ExternalIdentity `json:"-" bson:"identities,omitempty"`
+
+	PasswordResetToken   string             `json:"-" bson:"password_reset_token,omitempty"`
+	PasswordResetExpires primitive.DateTime `json:"-" bson:"password_reset_expires,omitempty"`
+
+	TOTPSecret    string   `json:"-" bson:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"-" bson:"totp_enabled"`
+	TOTPLastStep  int64    `json:"-" bson:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"-" bson:"recovery_codes,omitempty"`
+
+	DeletionScheduledFor primitive.DateTime  `json:"-" bson:"deletion_scheduled_for,omitempty"`
+	DeletionCourses      string              `json:"-" bson:"deletion_courses,omitempty"`
+	DeletionTransferTo   *primitive.ObjectID `json:"-" bson:"deletion_transfer_to,omitempty"`
+	DeletionClaimedUntil primitive.DateTime  `json:"-" bson:"deletion_claimed_until,omitempty"`
+}
+
+const (
+	DeletionTransferCourses = "transfer"
+	DeletionArchiveCourses  = "archive"
+)
+
+// ExternalIdentity links a user to an account at an OpenID Connect
+// provider. The issuer and subject together identify it; the provider is
+// the configured name it was linked through.
+type ExternalIdentity struct {
+	Provider string `json:"provider" bson:"provider"`
+	Issuer   string `json:"issuer" bson:"issuer"`
+	Subject  string `json:"subject" bson:"subject"`
+}
+
+// OIDCState is a pending external login, kept from the redirect to the
+// provider until its callback.
+type OIDCState struct {
+	State    string             `json:"state" bson:"_id"`
+	Date     primitive.DateTime `json:"date" bson:"date"`
+	Provider string             `json:"provider" bson:"provider"`
+	Nonce    string             `json:"nonce" bson:"nonce"`
+	Verifier string             `json:"verifier" bson:"verifier"`
+}
+
+// ExternalLogin is a login completed at a provider, kept until the
+// frontend exchanges its one-time code for a session. Only a hash of the
+// code is stored.
+type ExternalLogin struct {
+	CodeHash string             `json:"-" bson:"_id"`
+	Date     primitive.DateTime `json:"date" bson:"date"`
+	UserID   primitive.ObjectID `json:"user_id" bson:"user_id"`
 }
 
 type Rating struct {
@@ -38,3 +159,176 @@ type Rating struct {
 	Score  int                `json:"score" bson:"score"`
 	Review string             `json:"review" bson:"review"`
 }
+
+type Assignment struct {
+	Id           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Title        string             `json:"title" bson:"title"`
+	Instructions string             `json:"instructions" bson:"instructions"`
+	DueDate      primitive.DateTime `json:"due_date" bson:"due_date"`
+	MaxScore     int                `json:"max_score" bson:"max_score"`
+	AllowLate    bool               `json:"allow_late" bson:"allow_late"`
+	LatePenalty  int                `json:"late_penalty" bson:"late_penalty"`
+}
+
+type Submission struct {
+	Id           primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date         primitive.DateTime  `json:"date" bson:"date"`
+	AssignmentID primitive.ObjectID  `json:"assignment_id" bson:"assignment_id"`
+	CourseID     primitive.ObjectID  `json:"course_id" bson:"course_id"`
+	UserID       primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	Text         string              `json:"text" bson:"text"`
+	Files        []string            `json:"files" bson:"files"`
+	Late         bool                `json:"late" bson:"late"`
+	Score        *int                `json:"score" bson:"score"`
+	FinalScore   *int                `json:"final_score" bson:"final_score"`
+	Feedback     string              `json:"feedback" bson:"feedback"`
+	GradedAt     *primitive.DateTime `json:"graded_at" bson:"graded_at"`
+}
+
+type LessonRef struct {
+	Module int `json:"module" bson:"module"`
+	Lesson int `json:"lesson" bson:"lesson"`
+}
+
+type Progress struct {
+	Id               primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date             primitive.DateTime `json:"date" bson:"date"`
+	UserID           primitive.ObjectID `json:"user_id" bson:"user_id"`
+	CourseID         primitive.ObjectID `json:"course_id" bson:"course_id"`
+	CompletedLessons []LessonRef        `json:"completed_lessons" bson:"completed_lessons"`
+}
+
+type Certificate struct {
+	Id           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date         primitive.DateTime `json:"date" bson:"date"`
+	Code         string             `json:"code" bson:"code"`
+	UserID       primitive.ObjectID `json:"user_id" bson:"user_id"`
+	CourseID     primitive.ObjectID `json:"course_id" bson:"course_id"`
+	LearnerName  string             `json:"learner_name" bson:"learner_name"`
+	LearnerEmail string             `json:"learner_email" bson:"learner_email"`
+	CourseName   string             `json:"course_name" bson:"course_name"`
+	CreatorName  string             `json:"creator_name" bson:"creator_name"`
+}
+
+type LearningPath struct {
+	Id          primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date        primitive.DateTime   `json:"date" bson:"date"`
+	Name        string               `json:"name" bson:"name"`
+	Description string               `json:"description" bson:"description"`
+	CreatorID   primitive.ObjectID   `json:"creator_id" bson:"creator_id"`
+	Courses     []primitive.ObjectID `json:"courses" bson:"courses"`
+	Published   bool                 `json:"published" bson:"published"`
+}
+
+type Cohort struct {
+	Id               primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date             primitive.DateTime   `json:"date" bson:"date"`
+	CourseID         primitive.ObjectID   `json:"course_id" bson:"course_id"`
+	Name             string               `json:"name" bson:"name"`
+	StartDate        primitive.DateTime   `json:"start_date" bson:"start_date"`
+	EndDate          primitive.DateTime   `json:"end_date" bson:"end_date"`
+	EnrollmentOpens  primitive.DateTime   `json:"enrollment_opens" bson:"enrollment_opens"`
+	EnrollmentCloses primitive.DateTime   `json:"enrollment_closes" bson:"enrollment_closes"`
+	Capacity         int                  `json:"capacity" bson:"capacity"`
+	Members          []primitive.ObjectID `json:"members" bson:"members"`
+	Waitlist         []primitive.ObjectID `json:"waitlist" bson:"waitlist"`
+}
+
+type Thread struct {
+	Id             primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date           primitive.DateTime  `json:"date" bson:"date"`
+	CourseID       primitive.ObjectID  `json:"course_id" bson:"course_id"`
+	Lesson         *LessonRef          `json:"lesson,omitempty" bson:"lesson,omitempty"`
+	AuthorID       primitive.ObjectID  `json:"author_id" bson:"author_id"`
+	Title          string              `json:"title" bson:"title"`
+	Body           string              `json:"body" bson:"body"`
+	Pinned         bool                `json:"pinned" bson:"pinned"`
+	Locked         bool                `json:"locked" bson:"locked"`
+	AcceptedPostID *primitive.ObjectID `json:"accepted_post_id" bson:"accepted_post_id"`
+	ReplyCount     int                 `json:"reply_count" bson:"reply_count"`
+	LastActivity   primitive.DateTime  `json:"last_activity" bson:"last_activity"`
+	UpdatedAt      *primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+type Post struct {
+	Id        primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date      primitive.DateTime  `json:"date" bson:"date"`
+	ThreadID  primitive.ObjectID  `json:"thread_id" bson:"thread_id"`
+	ParentID  *primitive.ObjectID `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	AuthorID  primitive.ObjectID  `json:"author_id" bson:"author_id"`
+	Body      string              `json:"body" bson:"body"`
+	Deleted   bool                `json:"deleted" bson:"deleted"`
+	UpdatedAt *primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+type Note struct {
+	Id        primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date      primitive.DateTime  `json:"date" bson:"date"`
+	UserID    primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	CourseID  primitive.ObjectID  `json:"course_id" bson:"course_id"`
+	Lesson    LessonRef           `json:"lesson" bson:"lesson"`
+	Body      string              `json:"body" bson:"body"`
+	Timestamp *int                `json:"timestamp,omitempty" bson:"timestamp,omitempty"`
+	UpdatedAt *primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+type Bookmark struct {
+	Id       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date     primitive.DateTime `json:"date" bson:"date"`
+	UserID   primitive.ObjectID `json:"user_id" bson:"user_id"`
+	CourseID primitive.ObjectID `json:"course_id" bson:"course_id"`
+	Lesson   LessonRef          `json:"lesson" bson:"lesson"`
+}
+
+type SecurityEvent struct {
+	Id        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date      primitive.DateTime `json:"date" bson:"date"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Type      string             `json:"type" bson:"type"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"user_agent" bson:"user_agent"`
+}
+
+// LoginAttempt counts recent failed logins for one key, either an account
+// ("account:<email>") or a client address ("ip:<address>").
+type LoginAttempt struct {
+	Key         string             `json:"key" bson:"_id"`
+	Failures    int                `json:"failures" bson:"failures"`
+	LastFailure primitive.DateTime `json:"last_failure" bson:"last_failure"`
+	LockedUntil primitive.DateTime `json:"locked_until" bson:"locked_until"`
+}
+
+// APIKey lets scripts authenticate as a user without their password. Only
+// the hash of the key is stored; Prefix is kept so users can tell their
+// keys apart.
+type APIKey struct {
+	Id         primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date       primitive.DateTime  `json:"date" bson:"date"`
+	UserID     primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	Name       string              `json:"name" bson:"name"`
+	Prefix     string              `json:"prefix" bson:"prefix"`
+	Hash       string              `json:"-" bson:"hash"`
+	Scopes     []string            `json:"scopes" bson:"scopes"`
+	ExpiresAt  primitive.DateTime  `json:"expires_at" bson:"expires_at"`
+	LastUsedAt *primitive.DateTime `json:"last_used_at" bson:"last_used_at,omitempty"`
+	LastUsedIP string              `json:"last_used_ip,omitempty" bson:"last_used_ip,omitempty"`
+	RevokedAt  *primitive.DateTime `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// Session is one login. Its ID is the jti of the token issued for it, so
+// revoking the session revokes the token.
+type Session struct {
+	Id        primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Date      primitive.DateTime  `json:"date" bson:"date"`
+	UserID    primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	IP        string              `json:"ip" bson:"ip"`
+	UserAgent string              `json:"user_agent" bson:"user_agent"`
+	LastSeen  primitive.DateTime  `json:"last_seen" bson:"last_seen"`
+	ExpiresAt primitive.DateTime  `json:"expires_at" bson:"expires_at"`
+	RevokedAt *primitive.DateTime `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
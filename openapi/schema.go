@@ -0,0 +1,250 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+}
+
+var (
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	dateTimeType = reflect.TypeOf(primitive.DateTime(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	rawType      = reflect.TypeOf(json.RawMessage{})
+)
+
+// Schemas turns Go types into schemas. Named struct types become components
+// that schemas refer to, so each is described once.
+type Schemas struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+	// Rules describes validation tags of the binding engine that are not
+	// built in, like a custom password policy. It is copied into the
+	// description of the fields that use them.
+	Rules map[string]string
+}
+
+func NewSchemas() *Schemas {
+	return &Schemas{components: map[string]*Schema{}, names: map[reflect.Type]string{}, Rules: map[string]string{}}
+}
+
+// Components returns every component schema referred to so far.
+func (s *Schemas) Components() map[string]*Schema {
+	return s.components
+}
+
+// Add registers schema as a component under name, for shapes that have no
+// Go type.
+func (s *Schemas) Add(name string, schema *Schema) *Schema {
+	s.components[name] = schema
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// Of returns the schema of the type of v.
+func (s *Schemas) Of(v interface{}) *Schema {
+	return s.schema(reflect.TypeOf(v))
+}
+
+func (s *Schemas) schema(t reflect.Type) *Schema {
+	switch t {
+	case objectIDType:
+		return &Schema{Type: "string", Pattern: "^[0-9a-f]{24}$"}
+	case dateTimeType, timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := s.schema(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: s.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return s.component(t)
+	}
+	return &Schema{}
+}
+
+func (s *Schemas) component(t reflect.Type) *Schema {
+	name, ok := s.names[t]
+	if !ok {
+		name = s.componentName(t)
+		s.names[t] = name
+		// Reserve the name before describing the fields, so types that
+		// contain themselves refer to the component instead of recursing.
+		s.components[name] = &Schema{}
+		s.components[name] = s.object(t)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// componentName is the exported form of the type name, with type arguments
+// spelled out, like PageOfThread for page[models.Thread]. Types of another
+// package with a name already taken get their package name in front.
+func (s *Schemas) componentName(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		args := strings.Split(strings.TrimSuffix(name[i+1:], "]"), ",")
+		name = name[:i] + "Of"
+		for _, arg := range args {
+			name += exported(arg[strings.LastIndexByte(arg, '.')+1:])
+		}
+	}
+	name = exported(name)
+
+	if _, taken := s.components[name]; taken {
+		pkg := t.PkgPath()
+		name = exported(pkg[strings.LastIndexByte(pkg, '/')+1:]) + name
+	}
+	return name
+}
+
+func exported(name string) string {
+	if name == "" {
+		return name
+	}
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func (s *Schemas) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	s.addFields(schema, t)
+	return schema
+}
+
+func (s *Schemas) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		name := strings.SplitN(tag, ",", 2)[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.addFields(schema, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := s.schema(field.Type)
+		if s.applyBinding(property, field.Tag.Get("binding")) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// applyBinding copies the validation rules of a binding tag into schema and
+// reports whether the field is required. Rules after "dive" apply to the
+// elements of a slice.
+func (s *Schemas) applyBinding(schema *Schema, tag string) bool {
+	if tag == "" {
+		return false
+	}
+	required := false
+	target := schema
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = target == schema
+		case "dive":
+			if target.Items == nil {
+				return required
+			}
+			target = target.Items
+		case "email":
+			target.Format = "email"
+		case "http_url":
+			target.Format = "uri"
+		case "oneof":
+			for _, value := range strings.Fields(param) {
+				target.Enum = append(target.Enum, value)
+			}
+		case "min", "max":
+			applyBound(target, name, param)
+		default:
+			if description, ok := s.Rules[name]; ok {
+				target.Description = description
+			}
+		}
+	}
+	return required
+}
+
+func applyBound(schema *Schema, rule, param string) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	count := int(n)
+	switch {
+	case schema.Type == "string" && rule == "min":
+		schema.MinLength = &count
+	case schema.Type == "string":
+		schema.MaxLength = &count
+	case schema.Type == "array" && rule == "min":
+		schema.MinItems = &count
+	case schema.Type == "array":
+		schema.MaxItems = &count
+	case rule == "min":
+		schema.Minimum = &n
+	default:
+		schema.Maximum = &n
+	}
+}
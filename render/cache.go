@@ -0,0 +1,59 @@
+package render
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+type cacheEntry struct {
+	sum  [sha256.Size]byte
+	html string
+}
+
+// Cache keeps rendered HTML per course so markdown is only converted once
+// until the course is updated. Entries also remember a hash of their source,
+// so a stale entry is never served even if an invalidation was missed.
+type Cache struct {
+	mu      sync.RWMutex
+	entries map[string]map[string]cacheEntry
+}
+
+var HTMLCache = NewCache()
+
+func NewCache() *Cache {
+	return &Cache{entries: map[string]map[string]cacheEntry{}}
+}
+
+// HTML returns the sanitized HTML for source, rendering and storing it under
+// courseID/field when there is no valid cached copy.
+func (c *Cache) HTML(courseID, field, source string) (string, error) {
+	sum := sha256.Sum256([]byte(source))
+
+	c.mu.RLock()
+	entry, ok := c.entries[courseID][field]
+	c.mu.RUnlock()
+	if ok && entry.sum == sum {
+		return entry.html, nil
+	}
+
+	html, err := MarkdownToHTML(source)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if c.entries[courseID] == nil {
+		c.entries[courseID] = map[string]cacheEntry{}
+	}
+	c.entries[courseID][field] = cacheEntry{sum: sum, html: html}
+	c.mu.Unlock()
+
+	return html, nil
+}
+
+// Invalidate drops every cached rendering belonging to courseID.
+func (c *Cache) Invalidate(courseID string) {
+	c.mu.Lock()
+	delete(c.entries, courseID)
+	c.mu.Unlock()
+}
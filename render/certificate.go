@@ -0,0 +1,58 @@
+package render
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+type CertificateData struct {
+	LearnerName string
+	CourseName  string
+	CreatorName string
+	IssuedAt    time.Time
+	Code        string
+	VerifyURL   string
+}
+
+// CertificatePDF lays out a single landscape A4 page for a course
+// completion certificate.
+func CertificatePDF(data CertificateData) ([]byte, error) {
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pdf.SetTitle("Certificate of Completion - "+data.CourseName, true)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	width, height := pdf.GetPageSize()
+	pdf.SetLineWidth(1.5)
+	pdf.Rect(10, 10, width-20, height-20, "D")
+	pdf.SetLineWidth(0.3)
+	pdf.Rect(14, 14, width-28, height-28, "D")
+
+	line := func(y float64, size float64, style, text string) {
+		pdf.SetFont("Helvetica", style, size)
+		pdf.SetXY(20, y)
+		pdf.CellFormat(width-40, size*0.6, tr(text), "", 0, "C", false, 0, "")
+	}
+
+	line(40, 34, "B", "Certificate of Completion")
+	line(68, 14, "", "This certifies that")
+	line(82, 26, "B", data.LearnerName)
+	line(104, 14, "", "has successfully completed the course")
+	line(118, 22, "B", data.CourseName)
+	line(138, 13, "", "taught by "+data.CreatorName)
+	line(150, 13, "", "on "+data.IssuedAt.UTC().Format("January 2, 2006"))
+
+	line(172, 10, "", "Verification code: "+data.Code)
+	if data.VerifyURL != "" {
+		line(180, 10, "", "Verify at "+data.VerifyURL)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
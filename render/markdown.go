@@ -0,0 +1,32 @@
+package render
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+var (
+	converter = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+	// UGCPolicy drops <script>, event handler attributes and any URL whose
+	// scheme is not http, https or mailto (javascript: included).
+	policy = bluemonday.UGCPolicy()
+)
+
+// MarkdownToHTML renders markdown source and sanitizes the resulting HTML so
+// it can be embedded directly by the frontend.
+func MarkdownToHTML(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := converter.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return policy.Sanitize(buf.String()), nil
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiPrefix = "/api/v1"
+
+// The unversioned routes are deprecated since the /api/v1 routes were added
+// and will be removed at legacySunset.
+var (
+	legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset       = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// legacyRoute marks the response of an unversioned route as deprecated,
+// pointing at its /api/v1 successor, and logs the call so we can see who
+// still has to migrate before the routes are removed.
+func legacyRoute(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()))
+		c.Header("Sunset", legacySunset.Format(http.TimeFormat))
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successorPath(c, successor)))
+		log.Printf("legacy route %s %s used by %s (%s)", c.Request.Method, c.FullPath(), c.ClientIP(), c.Request.UserAgent())
+		c.Next()
+	}
+}
+
+// successorPath fills the parameters of the request into the successor's
+// path pattern.
+func successorPath(c *gin.Context, pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = c.Param(segment[1:])
+		}
+	}
+	return strings.Join(segments, "/")
+}
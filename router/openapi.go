@@ -0,0 +1,259 @@
+package router
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/auth"
+	"github.com/phcarneirobc/free-learn/handlers"
+	"github.com/phcarneirobc/free-learn/openapi"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+const (
+	bearerScheme = "bearerAuth"
+	apiKeyScheme = "apiKeyAuth"
+)
+
+// Spec describes every route New registers. Operations come from the route
+// table, with summaries and body types from handlers.Describe.
+func Spec() *openapi.Document {
+	schemas := openapi.NewSchemas()
+	schemas.Rules["password"] = "8 to 72 characters with at least one letter and one digit"
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "FreeLearn API",
+			Version:     "1",
+			Description: "Errors are RFC 7807 problem details with a machine readable code.",
+		},
+	}
+	operationIDs := map[string]bool{}
+	for _, rt := range routes() {
+		op := operation(schemas, rt)
+		op.OperationID = uniqueID(operationIDs, handlerName(rt.handlers[len(rt.handlers)-1]), rt.method)
+		doc.AddOperation(rt.method, openAPIPath(apiPrefix+rt.path), op)
+
+		if rt.legacy != "" {
+			legacy := *op
+			legacy.OperationID = uniqueID(operationIDs, op.OperationID+"Legacy", rt.legacyMethod)
+			legacy.Deprecated = true
+			legacy.Description = strings.TrimSpace(fmt.Sprintf("Deprecated alias of %s %s, removed on %s. %s",
+				rt.method, openAPIPath(apiPrefix+rt.path), legacySunset.Format("2 January 2006"), op.Description))
+			doc.AddOperation(rt.legacyMethod, openAPIPath(rt.legacy), &legacy)
+		}
+	}
+	addUnversioned(doc, schemas)
+
+	doc.Components = openapi.Components{
+		Schemas:   schemas.Components(),
+		Responses: problemResponses(schemas),
+		SecuritySchemes: map[string]openapi.SecurityScheme{
+			bearerScheme: {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "Session token from a login"},
+			apiKeyScheme: {Type: "apiKey", In: "header", Name: "X-API-Key",
+				Description: "API key; keys without the write scope may only use GET, HEAD and OPTIONS"},
+		},
+	}
+	return doc
+}
+
+func operation(schemas *openapi.Schemas, rt route) *openapi.Operation {
+	endpoint, _ := handlers.Describe(rt.handlers[len(rt.handlers)-1])
+	op := &openapi.Operation{
+		Summary:     endpoint.Summary,
+		Description: endpoint.Description,
+		Responses:   map[string]*openapi.Response{},
+	}
+	if endpoint.Tag != "" {
+		op.Tags = []string{endpoint.Tag}
+	}
+
+	for _, segment := range strings.Split(rt.path, "/") {
+		if strings.HasPrefix(segment, ":") {
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name: segment[1:], In: "path", Required: true, Schema: &openapi.Schema{Type: "string"},
+			})
+		}
+	}
+	for _, q := range endpoint.Query {
+		op.Parameters = append(op.Parameters, openapi.Parameter{
+			Name: q.Name, In: "query", Description: q.Description, Schema: &openapi.Schema{Type: "string"},
+		})
+	}
+	requests := endpoint.Requests
+	if endpoint.Request != nil {
+		requests = map[string]interface{}{"application/json": endpoint.Request}
+	}
+	if len(requests) > 0 {
+		op.RequestBody = &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{}}
+		for mediaType, body := range requests {
+			op.RequestBody.Content[mediaType] = openapi.MediaType{Schema: schemas.Of(body)}
+		}
+	}
+
+	status := endpoint.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := &openapi.Response{Description: http.StatusText(status)}
+	switch {
+	case endpoint.ContentType != "":
+		success.Content = map[string]openapi.MediaType{endpoint.ContentType: {Schema: &openapi.Schema{Type: "string", Format: "binary"}}}
+	case endpoint.Response != nil:
+		success.Content = map[string]openapi.MediaType{"application/json": {Schema: schemas.Of(endpoint.Response)}}
+	}
+	if status >= 300 && status < 400 {
+		success.Headers = map[string]openapi.Header{"Location": {Schema: &openapi.Schema{Type: "string", Format: "uri"}}}
+	}
+	op.Responses[fmt.Sprint(status)] = success
+
+	if op.RequestBody != nil || len(op.Parameters) > 0 {
+		op.Responses["400"] = openapi.ResponseRef("BadRequest")
+	}
+	if hasHandler(rt.handlers, auth.AuthenticateToken) {
+		op.Security = []openapi.SecurityRequirement{{bearerScheme: {}}}
+		if !hasHandler(rt.handlers, auth.RequireSession) {
+			op.Security = append(op.Security, openapi.SecurityRequirement{apiKeyScheme: {}})
+		}
+		op.Responses["401"] = openapi.ResponseRef("Unauthorized")
+		op.Responses["403"] = openapi.ResponseRef("Forbidden")
+	}
+	if hasHandler(rt.handlers, auth.RequireProfessor) {
+		op.Description = strings.TrimSpace("Only professors may call this. " + op.Description)
+	}
+	if strings.Contains(rt.path, "/:") {
+		op.Responses["404"] = openapi.ResponseRef("NotFound")
+	}
+	op.Responses["default"] = openapi.ResponseRef("Problem")
+	return op
+}
+
+// addUnversioned describes the routes outside of /api/v1.
+func addUnversioned(doc *openapi.Document, schemas *openapi.Schemas) {
+	jsonResponse := func(schema *openapi.Schema) map[string]*openapi.Response {
+		return map[string]*openapi.Response{"200": {
+			Description: "OK",
+			Content:     map[string]openapi.MediaType{"application/json": {Schema: schema}},
+		}}
+	}
+
+	doc.AddOperation(http.MethodGet, "/ping", &openapi.Operation{
+		Tags: []string{"Meta"}, Summary: "Check that the API is up", OperationID: "ping",
+		Responses: jsonResponse(schemas.Of(struct {
+			Message string `json:"message"`
+		}{})),
+	})
+	doc.AddOperation(http.MethodGet, "/.well-known/jwks.json", &openapi.Operation{
+		Tags: []string{"Meta"}, Summary: "Get the public keys tokens are signed with", OperationID: "jwks",
+		Responses: jsonResponse(&openapi.Schema{
+			Type:        "object",
+			Description: "JSON Web Key Set (RFC 7517)",
+			Properties:  map[string]*openapi.Schema{"keys": {Type: "array", Items: &openapi.Schema{Type: "object"}}},
+		}),
+	})
+	doc.AddOperation(http.MethodGet, "/openapi.json", &openapi.Operation{
+		Tags: []string{"Meta"}, Summary: "Get this document", OperationID: "openAPI",
+		Responses: jsonResponse(&openapi.Schema{Type: "object"}),
+	})
+	doc.AddOperation(http.MethodGet, "/docs", &openapi.Operation{
+		Tags: []string{"Meta"}, Summary: "Browse this document", OperationID: "docs",
+		Responses: map[string]*openapi.Response{"200": {
+			Description: "OK",
+			Content:     map[string]openapi.MediaType{"text/html": {Schema: &openapi.Schema{Type: "string"}}},
+		}},
+	})
+}
+
+func problemResponses(schemas *openapi.Schemas) map[string]*openapi.Response {
+	fieldError := schemas.Add("FieldError", &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"field":   {Type: "string", Description: `JSON path of the invalid value, like "modules[0].name"`},
+			"rule":    {Type: "string"},
+			"message": {Type: "string"},
+		},
+	})
+	problem := schemas.Add("Problem", &openapi.Schema{
+		Type:     "object",
+		Required: []string{"type", "title", "status", "code"},
+		Properties: map[string]*openapi.Schema{
+			"type":     {Type: "string"},
+			"title":    {Type: "string"},
+			"status":   {Type: "integer"},
+			"detail":   {Type: "string"},
+			"instance": {Type: "string"},
+			"code":     {Type: "string", Description: "Machine readable error code, like invalid_fields"},
+			"errors":   {Type: "array", Items: fieldError, Description: "The invalid fields of an invalid_fields error"},
+		},
+	})
+
+	response := func(description string) *openapi.Response {
+		return &openapi.Response{
+			Description: description,
+			Content:     map[string]openapi.MediaType{"application/problem+json": {Schema: problem}},
+		}
+	}
+	return map[string]*openapi.Response{
+		"BadRequest":   response("The request is invalid"),
+		"Unauthorized": response("Missing, invalid or expired credentials"),
+		"Forbidden":    response("The credentials do not allow this"),
+		"NotFound":     response("The resource does not exist"),
+		"Problem":      response("Any other error"),
+	}
+}
+
+func serveSpec(spec *openapi.Document) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	}
+}
+
+func serveDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+}
+
+// openAPIPath turns gin parameters like :id into OpenAPI ones like {id}.
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func hasHandler(chain []gin.HandlerFunc, handler gin.HandlerFunc) bool {
+	for _, h := range chain {
+		if reflect.ValueOf(h).Pointer() == reflect.ValueOf(handler).Pointer() {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerName is the function name of handler with a lower case first
+// letter, like getCourseByID.
+func handlerName(handler gin.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = name[strings.LastIndexByte(name, '.')+1:]
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// uniqueID returns id, or id followed by the method when it is taken, as
+// when one handler serves both PUT and PATCH.
+func uniqueID(taken map[string]bool, id, method string) string {
+	if taken[id] {
+		id += method[:1] + strings.ToLower(method[1:])
+	}
+	taken[id] = true
+	return id
+}
@@ -0,0 +1,161 @@
+package router
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/openapi"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/operations.golden from the current spec")
+
+func TestSpecCoversEveryRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spec := Spec()
+
+	for _, r := range New().Routes() {
+		path := openAPIPath(r.Path)
+		if !spec.HasOperation(r.Method, path) {
+			t.Errorf("%s %s is registered but missing from the OpenAPI spec", r.Method, r.Path)
+			continue
+		}
+		if spec.Paths[path][strings.ToLower(r.Method)].Summary == "" {
+			t.Errorf("%s %s has no summary; describe %s in handlers.Describe", r.Method, r.Path, r.Handler)
+		}
+	}
+}
+
+// TestSpecOperations compares every operation of the spec, with its request
+// and success response schemas, to a list kept in testdata. Since the spec
+// and the engine are built from the same route table, this is what catches
+// a route or body type changing by accident. Run with -update after
+// changing the API on purpose and review the diff.
+func TestSpecOperations(t *testing.T) {
+	golden := filepath.Join("testdata", "operations.golden")
+	got := operationList(Spec())
+
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotLines, wantLines := lineSet(got), lineSet(string(want))
+	for line := range wantLines {
+		if !gotLines[line] {
+			t.Errorf("missing or changed: %s", line)
+		}
+	}
+	for line := range gotLines {
+		if !wantLines[line] {
+			t.Errorf("unexpected: %s", line)
+		}
+	}
+}
+
+// operationList writes one line per operation, like
+// "POST /api/v1/courses CourseInput -> 201 Course".
+func operationList(doc *openapi.Document) string {
+	lines := []string{}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			request := "-"
+			if op.RequestBody != nil {
+				types := []string{}
+				for mediaType, content := range op.RequestBody.Content {
+					types = append(types, mediaType+":"+schemaName(content.Schema))
+				}
+				sort.Strings(types)
+				request = strings.Join(types, ",")
+			}
+
+			response := ""
+			for status, r := range op.Responses {
+				if !strings.HasPrefix(status, "2") && !strings.HasPrefix(status, "3") {
+					continue
+				}
+				response = status + " -"
+				for mediaType, content := range r.Content {
+					response = fmt.Sprintf("%s %s:%s", status, mediaType, schemaName(content.Schema))
+				}
+			}
+
+			line := fmt.Sprintf("%s %s %s -> %s", strings.ToUpper(method), path, request, response)
+			if op.Deprecated {
+				line += " (deprecated)"
+			}
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func schemaName(schema *openapi.Schema) string {
+	switch {
+	case schema == nil:
+		return "-"
+	case schema.Ref != "":
+		return schema.Ref[strings.LastIndexByte(schema.Ref, '/')+1:]
+	case schema.Type == "array":
+		return "[]" + schemaName(schema.Items)
+	default:
+		return schema.Type
+	}
+}
+
+func lineSet(text string) map[string]bool {
+	set := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		set[line] = true
+	}
+	return set
+}
+
+func TestSpecIsServed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := New()
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: status %d", w.Code)
+	}
+	var spec struct {
+		OpenAPI    string                 `json:"openapi"`
+		Paths      map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") || len(spec.Paths) == 0 {
+		t.Errorf("unexpected document: openapi %q with %d paths", spec.OpenAPI, len(spec.Paths))
+	}
+	for _, name := range []string{"Problem", "CourseInput", "CourseResponse"} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is missing", name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/openapi.json") {
+		t.Errorf("GET /docs: status %d", w.Code)
+	}
+}
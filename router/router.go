@@ -1,16 +1,144 @@
 package router
 
 import (
+	"net/http"
+	"os"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"github.com/phcarneirobc/free-learn/apperror"
 	"github.com/phcarneirobc/free-learn/auth"
 	"github.com/phcarneirobc/free-learn/db"
 	"github.com/phcarneirobc/free-learn/handlers"
+	"github.com/phcarneirobc/free-learn/identity"
 )
 
-func Start(port string) {
+// route is one endpoint of the API. Path is relative to /api/v1. Legacy is
+// the unversioned path the endpoint had before, if any, which stays
+// available as a deprecated alias answering legacyMethod, the verb it had
+// before.
+type route struct {
+	method       string
+	path         string
+	legacyMethod string
+	legacy       string
+	handlers     []gin.HandlerFunc
+}
+
+func chain(handlers ...gin.HandlerFunc) []gin.HandlerFunc {
+	return handlers
+}
+
+func routes() []route {
+	authed := auth.AuthenticateToken
+	professor := auth.RequireProfessor
+	session := auth.RequireSession
+
+	return []route{
+		{http.MethodGet, "/courses", http.MethodGet, "/get", chain(handlers.GetAllCourses)},
+		{http.MethodGet, "/courses/search", http.MethodGet, "/search", chain(handlers.SearchCourses)},
+		{http.MethodPost, "/users", http.MethodPost, "/register", chain(handlers.Register)},
+		{http.MethodPost, "/auth/login", http.MethodPost, "/login", chain(handlers.Login)},
+		{http.MethodPost, "/auth/login/2fa", http.MethodPost, "/login/2fa", chain(handlers.LoginTwoFactor)},
+		{http.MethodGet, "/auth/oidc/providers", http.MethodGet, "/auth/oidc/providers", chain(handlers.GetIdentityProviders)},
+		{http.MethodGet, "/auth/oidc/login/:provider", http.MethodGet, "/auth/oidc/login/:provider", chain(handlers.StartExternalLogin)},
+		{http.MethodGet, "/auth/oidc/callback/:provider", http.MethodGet, "/auth/oidc/callback/:provider", chain(handlers.ExternalLoginCallback)},
+		{http.MethodPost, "/auth/oidc/exchange", "", "", chain(handlers.ExchangeExternalLogin)},
+		{http.MethodGet, "/certificate-verifications/:code", http.MethodGet, "/certificates/verify/:code", chain(handlers.VerifyCertificate)},
+		{http.MethodGet, "/paths", http.MethodGet, "/paths/get", chain(handlers.GetLearningPaths)},
+		{http.MethodGet, "/instructors/:id", http.MethodGet, "/instructors/:id", chain(handlers.GetInstructorProfile)},
+		{http.MethodGet, "/profile", http.MethodGet, "/profile", chain(authed, handlers.GetProfile)},
+		{http.MethodPut, "/profile", http.MethodPut, "/profile", chain(authed, handlers.UpdateProfile)},
+		{http.MethodPost, "/account/email/confirm", http.MethodPost, "/account/email/confirm", chain(handlers.ConfirmEmailChange)},
+		{http.MethodPost, "/account/password/forgot", http.MethodPost, "/account/password/forgot", chain(handlers.ForgotPassword)},
+		{http.MethodPost, "/account/password/reset", http.MethodPost, "/account/password/reset", chain(handlers.ResetPassword)},
+
+		{http.MethodPost, "/courses", http.MethodPost, "/courses/post", chain(authed, professor, handlers.PostCourse)},
+		{http.MethodGet, "/courses/:id", http.MethodGet, "/courses/get/:id", chain(authed, handlers.GetCourseByID)},
+		{http.MethodPut, "/courses/:id", http.MethodPut, "/courses/update/:id", chain(authed, professor, handlers.UpdateCourseValue)},
+		{http.MethodPatch, "/courses/:id", "", "", chain(authed, professor, handlers.PatchCourse)},
+		{http.MethodDelete, "/courses/:id", http.MethodDelete, "/courses/delete/:id", chain(authed, professor, handlers.DeleteCourse)},
+		{http.MethodGet, "/courses/:id/description", http.MethodGet, "/courses/get/:id/description", chain(authed, handlers.GetCourseDescription)},
+		{http.MethodGet, "/courses/:id/lessons/:module/:lesson", http.MethodGet, "/courses/get/:id/lesson/:module/:lesson", chain(authed, handlers.GetLessonContent)},
+		{http.MethodPost, "/courses/:id/ratings", http.MethodPost, "/courses/rate/:id", chain(authed, handlers.RateCourse)},
+		{http.MethodPost, "/users/:id/enrollments", http.MethodPost, "/courses/add-course-to-user/:id", chain(authed, handlers.AddCourseToUser)},
+		{http.MethodGet, "/users/:id/enrollments", http.MethodGet, "/courses/get-user-courses/:id", chain(authed, handlers.GetUserCourses)},
+		{http.MethodGet, "/courses/:id/modules/:module/quiz", http.MethodGet, "/courses/quiz/:id/:module", chain(authed, handlers.GetQuiz)},
+		{http.MethodPost, "/courses/:id/modules/:module/quiz/attempts", http.MethodPost, "/courses/quiz/:id/:module/attempts", chain(authed, handlers.SubmitQuizAttempt)},
+		{http.MethodGet, "/courses/:id/modules/:module/quiz/attempts", http.MethodGet, "/courses/quiz/:id/:module/attempts", chain(authed, handlers.GetQuizAttempts)},
+		{http.MethodPost, "/courses/:id/assignments/:assignment/submissions", http.MethodPost, "/courses/assignments/:id/:assignment/submit", chain(authed, handlers.SubmitAssignment)},
+		{http.MethodGet, "/courses/:id/assignments/:assignment/submissions", http.MethodGet, "/courses/assignments/:id/:assignment/submissions", chain(authed, handlers.GetAssignmentSubmissions)},
+		{http.MethodPost, "/submissions/:id/grade", http.MethodPost, "/courses/submissions/grade/:id", chain(authed, professor, handlers.GradeSubmission)},
+		{http.MethodGet, "/courses/:id/gradebook", http.MethodGet, "/courses/gradebook/:id", chain(authed, professor, handlers.GetGradebook)},
+		{http.MethodGet, "/courses/:id/progress", http.MethodGet, "/courses/progress/:id", chain(authed, handlers.GetCourseProgress)},
+		{http.MethodPost, "/courses/:id/progress/:module/:lesson", http.MethodPost, "/courses/progress/:id/:module/:lesson", chain(authed, handlers.CompleteLesson)},
+		{http.MethodGet, "/certificates", http.MethodGet, "/courses/certificates", chain(authed, handlers.GetUserCertificates)},
+		{http.MethodGet, "/certificates/:id/pdf", http.MethodGet, "/courses/certificates/:id/pdf", chain(authed, handlers.DownloadCertificate)},
+		{http.MethodPost, "/courses/:id/cohorts", http.MethodPost, "/courses/cohorts/post/:id", chain(authed, professor, handlers.PostCohort)},
+		{http.MethodGet, "/courses/:id/cohorts", http.MethodGet, "/courses/cohorts/get/:id", chain(authed, handlers.GetCourseCohorts)},
+		{http.MethodPost, "/cohorts/:id/enrollment", http.MethodPost, "/courses/cohorts/enroll/:id", chain(authed, handlers.EnrollInCohort)},
+		{http.MethodDelete, "/cohorts/:id/enrollment", http.MethodPost, "/courses/cohorts/leave/:id", chain(authed, handlers.LeaveCohort)},
+		{http.MethodGet, "/cohorts/:id/roster", http.MethodGet, "/courses/cohorts/roster/:id", chain(authed, professor, handlers.GetCohortRoster)},
+		{http.MethodPost, "/courses/:id/lessons/:module/:lesson/notes", http.MethodPost, "/courses/notes/:id/:module/:lesson", chain(authed, handlers.PostNote)},
+		{http.MethodPost, "/courses/:id/lessons/:module/:lesson/bookmark", http.MethodPost, "/courses/bookmarks/:id/:module/:lesson", chain(authed, handlers.PostBookmark)},
+		{http.MethodDelete, "/courses/:id/lessons/:module/:lesson/bookmark", http.MethodDelete, "/courses/bookmarks/:id/:module/:lesson", chain(authed, handlers.DeleteBookmark)},
+
+		{http.MethodPost, "/paths", http.MethodPost, "/paths/post", chain(authed, professor, handlers.PostLearningPath)},
+		{http.MethodGet, "/paths/:id", http.MethodGet, "/paths/get/:id", chain(authed, handlers.GetLearningPathByID)},
+		{http.MethodPut, "/paths/:id", http.MethodPut, "/paths/update/:id", chain(authed, professor, handlers.UpdateLearningPath)},
+		{http.MethodPost, "/paths/:id/publish", http.MethodPost, "/paths/publish/:id", chain(authed, professor, handlers.PublishLearningPath)},
+		{http.MethodDelete, "/paths/:id", http.MethodDelete, "/paths/delete/:id", chain(authed, professor, handlers.DeleteLearningPath)},
+		{http.MethodPost, "/paths/:id/enrollments", http.MethodPost, "/paths/enroll/:id", chain(authed, handlers.EnrollInLearningPath)},
+		{http.MethodGet, "/paths/:id/progress", http.MethodGet, "/paths/progress/:id", chain(authed, handlers.GetLearningPathProgress)},
+
+		{http.MethodGet, "/courses/:id/threads", http.MethodGet, "/discussions/course/:id", chain(authed, handlers.GetCourseThreads)},
+		{http.MethodPost, "/courses/:id/threads", http.MethodPost, "/discussions/course/:id", chain(authed, handlers.PostThread)},
+		{http.MethodGet, "/threads/:id", http.MethodGet, "/discussions/get/:id", chain(authed, handlers.GetThread)},
+		{http.MethodPut, "/threads/:id", http.MethodPut, "/discussions/update/:id", chain(authed, handlers.UpdateThread)},
+		{http.MethodDelete, "/threads/:id", http.MethodDelete, "/discussions/delete/:id", chain(authed, handlers.DeleteThread)},
+		{http.MethodPost, "/threads/:id/posts", http.MethodPost, "/discussions/reply/:id", chain(authed, handlers.ReplyToThread)},
+		{http.MethodPost, "/threads/:id/pin", http.MethodPost, "/discussions/pin/:id", chain(authed, handlers.PinThread)},
+		{http.MethodPost, "/threads/:id/lock", http.MethodPost, "/discussions/lock/:id", chain(authed, handlers.LockThread)},
+		{http.MethodPost, "/threads/:id/accepted-answer", http.MethodPost, "/discussions/accept/:id", chain(authed, handlers.AcceptAnswer)},
+		{http.MethodPut, "/posts/:id", http.MethodPut, "/discussions/posts/:id", chain(authed, handlers.UpdatePost)},
+		{http.MethodDelete, "/posts/:id", http.MethodDelete, "/discussions/posts/:id", chain(authed, handlers.DeletePost)},
+
+		{http.MethodGet, "/notes", http.MethodGet, "/notes/get", chain(authed, handlers.GetUserNotes)},
+		{http.MethodGet, "/notes/export", http.MethodGet, "/notes/export", chain(authed, handlers.ExportNotes)},
+		{http.MethodPut, "/notes/:id", http.MethodPut, "/notes/update/:id", chain(authed, handlers.UpdateNote)},
+		{http.MethodDelete, "/notes/:id", http.MethodDelete, "/notes/delete/:id", chain(authed, handlers.DeleteNote)},
+		{http.MethodGet, "/bookmarks", http.MethodGet, "/bookmarks/get", chain(authed, handlers.GetUserBookmarks)},
+
+		{http.MethodPost, "/account/password", http.MethodPost, "/account/password", chain(authed, session, handlers.ChangePassword)},
+		{http.MethodPost, "/account/email", http.MethodPost, "/account/email", chain(authed, session, handlers.RequestEmailChange)},
+		{http.MethodGet, "/account/security-events", http.MethodGet, "/account/security-events", chain(authed, session, handlers.GetSecurityEvents)},
+		{http.MethodPost, "/account/2fa/setup", http.MethodPost, "/account/2fa/setup", chain(authed, session, handlers.SetupTwoFactor)},
+		{http.MethodPost, "/account/2fa/confirm", http.MethodPost, "/account/2fa/confirm", chain(authed, session, handlers.ConfirmTwoFactor)},
+		{http.MethodPost, "/account/2fa/disable", http.MethodPost, "/account/2fa/disable", chain(authed, session, handlers.DisableTwoFactor)},
+		{http.MethodPost, "/account/2fa/recovery-codes", http.MethodPost, "/account/2fa/recovery-codes", chain(authed, session, handlers.RegenerateRecoveryCodes)},
+		{http.MethodPost, "/account/api-keys", http.MethodPost, "/account/api-keys", chain(authed, session, handlers.PostAPIKey)},
+		{http.MethodGet, "/account/api-keys", http.MethodGet, "/account/api-keys", chain(authed, session, handlers.GetAPIKeys)},
+		{http.MethodDelete, "/account/api-keys/:id", http.MethodDelete, "/account/api-keys/:id", chain(authed, session, handlers.RevokeAPIKey)},
+		{http.MethodGet, "/account/sessions", http.MethodGet, "/account/sessions", chain(authed, session, handlers.GetSessions)},
+		{http.MethodDelete, "/account/sessions/:id", http.MethodDelete, "/account/sessions/:id", chain(authed, session, handlers.RevokeSession)},
+		{http.MethodDelete, "/account/sessions", http.MethodDelete, "/account/sessions", chain(authed, session, handlers.RevokeOtherSessions)},
+
+		{http.MethodGet, "/me/export", http.MethodGet, "/me/export", chain(authed, session, handlers.ExportUserData)},
+		{http.MethodDelete, "/me", http.MethodDelete, "/me", chain(authed, session, handlers.RequestAccountDeletion)},
+		{http.MethodDelete, "/me/deletion", http.MethodPost, "/me/delete/cancel", chain(authed, session, handlers.CancelAccountDeletion)},
+	}
+}
+
+// New builds the engine with every route of the API.
+func New() *gin.Engine {
 	r := gin.Default()
 
 	r.Use(CORSMiddleware())
+	r.NoRoute(func(c *gin.Context) {
+		apperror.Respond(c, apperror.NotFound("route_not_found", "No route matches "+c.Request.Method+" "+c.Request.URL.Path))
+	})
+
+	r.GET("/.well-known/jwks.json", auth.JWKS)
 
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -18,22 +146,22 @@ func Start(port string) {
 		})
 	})
 
-	r.GET("/get", handlers.GetAllCourses)
-	r.GET("/search", handlers.SearchCourses)
-	r.POST("/register", handlers.Register)
-	r.POST("/login", handlers.Login)
-
-	pg := r.Group("/courses")
-	pg.Use(auth.AuthenticateToken)
-	pg.POST("/post", auth.RequireProfessor, handlers.PostCourse)
-	pg.GET("/get/:id", handlers.GetCourseByID)
-	pg.PUT("/update/:id", auth.RequireProfessor, handlers.UpdateCourseValue)
-	pg.DELETE("/delete/:id", auth.RequireProfessor, handlers.DeleteCourse)
-	pg.POST("/add-course-to-user/:id", handlers.AddCourseToUser)
-	pg.POST("/rate/:id", handlers.RateCourse)
-	pg.GET("/get-user-courses/:id", handlers.GetUserCourses)
-
-	err := r.Run(port)
+	r.GET("/openapi.json", serveSpec(Spec()))
+	r.GET("/docs", serveDocs)
+
+	v1 := r.Group(apiPrefix)
+	for _, rt := range routes() {
+		v1.Handle(rt.method, rt.path, rt.handlers...)
+		if rt.legacy != "" {
+			legacy := append(chain(legacyRoute(apiPrefix+rt.path)), rt.handlers...)
+			r.Handle(rt.legacyMethod, rt.legacy, legacy...)
+		}
+	}
+	return r
+}
+
+func Start(port string) {
+	err := New().Run(port)
 	if err != nil {
 		panic(err)
 	}
@@ -41,7 +169,18 @@ func Start(port string) {
 }
 
 func PrepareApp() error {
-	return db.StartDB()
+	if err := auth.Init(); err != nil {
+		return err
+	}
+	if err := db.StartDB(); err != nil {
+		return err
+	}
+	registry := identity.NewRegistry(identity.ConfigsFromEnv()...)
+	if err := handlers.ConfigureIdentityProviders(registry, os.Getenv("OIDC_LOGIN_REDIRECT_URL")); err != nil {
+		return err
+	}
+	handlers.StartAccountPurger(time.Hour)
+	return nil
 }
 
 func CORSMiddleware() gin.HandlerFunc {
@@ -49,7 +188,8 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Deprecation, Sunset, Link, Retry-After")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return